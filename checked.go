@@ -0,0 +1,172 @@
+package cmap
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+)
+
+// ErrUnhashableKey is matched, by errors.Is, by the errors the checked
+// methods of CMap return for a key that can not be hashed.
+var ErrUnhashableKey = errors.New("cmap: unhashable key")
+
+// UnhashableKeyError reports a key that can not be hashed, because it is or
+// holds an interface value whose dynamic type is a slice, map or func.
+// Such keys panic in the unchecked methods, as they do in a built-in map.
+type UnhashableKeyError struct {
+	Type reflect.Type // dynamic type of the key
+}
+
+func (e *UnhashableKeyError) Error() string {
+	return "cmap: unhashable key of type " + e.Type.String()
+}
+
+func (e *UnhashableKeyError) Is(target error) bool {
+	return target == ErrUnhashableKey
+}
+
+// CheckKey returns an *UnhashableKeyError if key can not be hashed, and nil
+// otherwise. Keys of a type that holds no interface are always hashable, and
+// are not inspected.
+func CheckKey[K comparable](key K) error {
+	if !keyHoldsInterface[K]() {
+		return nil
+	}
+	v := reflect.ValueOf(key)
+	if !v.IsValid() || v.Comparable() {
+		// A nil interface key is hashable.
+		return nil
+	}
+	return &UnhashableKeyError{Type: v.Type()}
+}
+
+// interfaceKeys caches holdsInterface by key type.
+var interfaceKeys sync.Map
+
+// keyHoldsInterface reports whether keys of type K can hold an interface
+// value, computed once per K.
+func keyHoldsInterface[K comparable]() bool {
+	t := reflect.TypeFor[K]()
+	if holds, ok := interfaceKeys.Load(t); ok {
+		return holds.(bool)
+	}
+	holds := holdsInterface(t)
+	interfaceKeys.Store(t, holds)
+	return holds
+}
+
+// holdsInterface reports whether t is an interface type, or an array or
+// struct with an element or field of one.
+func holdsInterface(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Array:
+		return holdsInterface(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if holdsInterface(t.Field(i).Type) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TryLoad is like Load, but returns an error instead of panicking if key
+// can not be hashed.
+func (m *CMap[K, V]) TryLoad(key K) (value V, ok bool, err error) {
+	if err = CheckKey(key); err != nil {
+		return value, false, err
+	}
+	value, ok = m.Load(key)
+	return value, ok, nil
+}
+
+// TryStore is like Store, but returns an error instead of panicking if key
+// can not be hashed.
+func (m *CMap[K, V]) TryStore(key K, value V) error {
+	if err := CheckKey(key); err != nil {
+		return err
+	}
+	m.Store(key, value)
+	return nil
+}
+
+// TryLoadOrStore is like LoadOrStore, but returns an error instead of
+// panicking if key can not be hashed.
+func (m *CMap[K, V]) TryLoadOrStore(key K, value V) (actual V, loaded bool, err error) {
+	if err = CheckKey(key); err != nil {
+		return actual, false, err
+	}
+	actual, loaded = m.LoadOrStore(key, value)
+	return actual, loaded, nil
+}
+
+// TrySwap is like Swap, but returns an error instead of panicking if key
+// can not be hashed.
+func (m *CMap[K, V]) TrySwap(key K, value V) (previous V, loaded bool, err error) {
+	if err = CheckKey(key); err != nil {
+		return previous, false, err
+	}
+	previous, loaded = m.Swap(key, value)
+	return previous, loaded, nil
+}
+
+// TryDelete is like Delete, but returns an error instead of panicking if key
+// can not be hashed.
+func (m *CMap[K, V]) TryDelete(key K) error {
+	if err := CheckKey(key); err != nil {
+		return err
+	}
+	m.Delete(key)
+	return nil
+}
+
+// TryLoadAndDelete is like LoadAndDelete, but returns an error instead of
+// panicking if key can not be hashed.
+func (m *CMap[K, V]) TryLoadAndDelete(key K) (value V, loaded bool, err error) {
+	if err = CheckKey(key); err != nil {
+		return value, false, err
+	}
+	value, loaded = m.LoadAndDelete(key)
+	return value, loaded, nil
+}
+
+// TryCompareAndSwap is like CompareAndSwap, but returns an error instead of
+// panicking if key can not be hashed.
+func (m *CMap[K, V]) TryCompareAndSwap(key K, old, new V) (swapped bool, err error) {
+	if err = CheckKey(key); err != nil {
+		return false, err
+	}
+	return m.CompareAndSwap(key, old, new), nil
+}
+
+// TryCompareAndDelete is like CompareAndDelete, but returns an error instead
+// of panicking if key can not be hashed.
+func (m *CMap[K, V]) TryCompareAndDelete(key K, old V) (deleted bool, err error) {
+	if err = CheckKey(key); err != nil {
+		return false, err
+	}
+	return m.CompareAndDelete(key, old), nil
+}
+
+// TryLoadOrCompute is like LoadOrCompute, but returns an error instead of
+// panicking if key can not be hashed. valueFn is not called then.
+func (m *CMap[K, V]) TryLoadOrCompute(key K, valueFn func() V) (actual V, loaded bool, err error) {
+	if err = CheckKey(key); err != nil {
+		return actual, false, err
+	}
+	actual, loaded = m.LoadOrCompute(key, valueFn)
+	return actual, loaded, nil
+}
+
+// TryCompute is like Compute, but returns an error instead of panicking if
+// key can not be hashed. f is not called then.
+func (m *CMap[K, V]) TryCompute(key K, f func(old V, loaded bool) (new V, op ComputeOp)) (actual V, ok bool, err error) {
+	if err = CheckKey(key); err != nil {
+		return actual, false, err
+	}
+	actual, ok = m.Compute(key, f)
+	return actual, ok, nil
+}
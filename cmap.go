@@ -1,74 +1,238 @@
 package cmap
 
 import (
+	"context"
+	"iter"
+	"maps"
+	"math/bits"
 	"runtime"
+	"slices"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
 const (
 	mInitBit      = 4
 	mInitSize     = 1 << mInitBit
+	mMaxBit       = 31
+	evacuteStep   = 2 // buckets evacuted by each write in EvacuateIncremental mode
 	uint32JodDone = 1
 	uint32Jodinit = 0
 )
 
-// CMap is a "thread" safe Cmap of type AnyComparableType:Any.
+// ComputeOp tells Compute what to do with the value returned by its callback.
+type ComputeOp uint8
+
+const (
+	// ComputeKeep leaves the entry for the key unchanged.
+	ComputeKeep ComputeOp = iota
+	// ComputeUpdate stores the returned value for the key.
+	ComputeUpdate
+	// ComputeDelete deletes the key, if present.
+	ComputeDelete
+)
+
+// CMap is a "thread" safe Cmap of type K:V.
 // To avoid lock bottlenecks this Cmap is dived to several Cmap shards.
-type CMap struct {
+//
+// The zero CMap is empty and ready for use. A CMap must not be copied after first use.
+type CMap[K comparable, V any] struct {
 	// mu    sync.Mutex
-	count int64
+	count counter
 	node  unsafe.Pointer
+	walks sync.Pool // *[]Entry[K, V], reused by Range
+	cfg   *config   // nil uses defaultConfig
+	stats resizeStats
 }
 
-type node struct {
+type node[K comparable, V any] struct {
 	mask    uintptr        // 1<<B - 1
 	B       uint8          // log_2 of # of buckets (can hold up to loadFactor * 2^B items)
 	resize  uint32         // 重新计算进程，0表示完成，1表示正在进行
 	oldNode unsafe.Pointer // *node
-	buckets []bucket
+	buckets []bucket[K, V]
+	seed    hashSeed  // hash seed, the same for every node of a map
+	hasher  Hasher[K] // nil hashes and compares keys as they are
+
+	left int64         // buckets still to evacute from oldNode
+	next uint32        // next bucket for incremental evacution
+	done chan struct{} // closed once every bucket has been evacuted
+
+	owner *CMap[K, V] // map n was resized for, nil for an initial node
+	start time.Time   // when the resize to n started
+	moved int64       // elements evacuted from oldNode
 }
 
-type bucket struct {
+// Entry is a key and its value, as copied out of a CMap by Scan.
+type Entry[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
+type bucket[K comparable, V any] struct {
 	mu       sync.RWMutex
 	init     sync.Once
-	evacuted uint32      // 1 表示oldNode对应buckut已经迁移到新buckut
-	frozen   uint32      // true表示当前bucket已经冻结，进行resize
-	m        map[any]any //
+	evacuted uint32  // 1 表示oldNode对应buckut已经迁移到新buckut
+	frozen   bool    // true表示当前bucket已经冻结，进行resize; guarded by mu
+	shared   uint32  // 1 once a Snapshot holds m or hm, which writes must then copy first
+	m        map[K]V // entries, only without a hasher
+
+	hasher Hasher[K]                 // as the node's
+	hm     map[uintptr][]Entry[K, V] // entries by hash, only with a hasher
+	hn     int                       // number of entries in hm
 }
 
-// Load returns the value stored in the Cmap for a key, or nil if no
-// value is present.
+// Load returns the value stored in the Cmap for a key, or the zero value
+// if no value is present.
 // The ok result indicates whether value was found in the Cmap.
-func (m *CMap) Load(key any) (value any, ok bool) {
-	hash := chash(key)
+func (m *CMap[K, V]) Load(key K) (value V, ok bool) {
+	hash := m.hash(key)
 	_, b := m.getNodeAndBucket(hash)
-	value, ok = b.tryLoad(key)
+	value, ok = b.tryLoad(hash, key)
 	return
 }
 
 // Store sets the value for a key.
-func (m *CMap) Store(key, value any) {
-	hash := chash(key)
+func (m *CMap[K, V]) Store(key K, value V) {
+	hash := m.hash(key)
 	for {
 		n, b := m.getNodeAndBucket(hash)
-		if b.tryStore(m, n, key, value) {
+		if resize, ok := b.tryStore(m, n, hash, key, value); ok {
+			m.written(n, resize)
 			return
 		}
+		runtime.Gosched()
 	}
 }
 
 // LoadOrStore returns the existing value for the key if present.
 // Otherwise, it stores and returns the given value.
 // The loaded result is true if the value was loaded, false if stored.
-func (m *CMap) LoadOrStore(key, value any) (actual any, loaded bool) {
-	hash := chash(key)
+func (m *CMap[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
+	hash := m.hash(key)
+	var (
+		resize uint8
+		ok     bool
+	)
+	for {
+		n, b := m.getNodeAndBucket(hash)
+		actual, loaded, resize, ok = b.tryLoadOrStore(m, n, hash, key, value)
+		if ok {
+			m.written(n, resize)
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+// Swap swaps the value for a key and returns the previous value if any.
+// The loaded result reports whether the key was present.
+func (m *CMap[K, V]) Swap(key K, value V) (previous V, loaded bool) {
+	hash := m.hash(key)
+	var (
+		resize uint8
+		ok     bool
+	)
+	for {
+		n, b := m.getNodeAndBucket(hash)
+		previous, loaded, resize, ok = b.trySwap(m, n, hash, key, value)
+		if ok {
+			m.written(n, resize)
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+// CompareAndSwap swaps the old and new values for key
+// if the value stored in the map is equal to old.
+// The old value must be of a comparable type.
+func (m *CMap[K, V]) CompareAndSwap(key K, old, new V) (swapped bool) {
+	hash := m.hash(key)
 	var ok bool
+	for {
+		_, b := m.getNodeAndBucket(hash)
+		swapped, ok = b.tryCompareAndSwap(hash, key, old, new)
+		if ok {
+			m.evacuteWork()
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+// CompareAndDelete deletes the entry for key if its value is equal to old.
+// The old value must be of a comparable type.
+//
+// If there is no current value for key in the map, CompareAndDelete
+// returns false (even if the old value is the nil interface value).
+func (m *CMap[K, V]) CompareAndDelete(key K, old V) (deleted bool) {
+	hash := m.hash(key)
+	var (
+		resize uint8
+		ok     bool
+	)
 	for {
 		n, b := m.getNodeAndBucket(hash)
-		actual, loaded, ok = b.tryLoadOrStore(m, n, key, value)
+		deleted, resize, ok = b.tryCompareAndDelete(m, n, hash, key, old)
 		if ok {
+			m.written(n, resize)
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+// Compute atomically computes the value for a key.
+//
+// f is called with the current value for the key and whether it is present,
+// while the key's bucket is locked, so no other goroutine can change the key
+// until f returns. The returned op decides whether the value returned by f is
+// stored, the key is deleted, or the entry is kept as it is. f must not call
+// methods on the map, or it may deadlock.
+//
+// If the bucket is being resized, Compute waits for it and f is only called
+// once, against the bucket that holds the key.
+//
+// Compute returns the value for the key after the operation, and ok
+// reports whether the key is present.
+func (m *CMap[K, V]) Compute(key K, f func(old V, loaded bool) (new V, op ComputeOp)) (actual V, ok bool) {
+	hash := m.hash(key)
+	var (
+		resize uint8
+		done   bool
+	)
+	for {
+		n, b := m.getNodeAndBucket(hash)
+		actual, ok, resize, done = b.tryCompute(m, n, hash, key, f)
+		if done {
+			m.written(n, resize)
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+// LoadOrCompute returns the existing value for the key if present.
+// Otherwise, it calls valueFn, stores and returns the computed value.
+// The loaded result is true if the value was loaded, false if stored.
+//
+// valueFn is only called when the key is absent, while the key's bucket is
+// locked, so it never runs concurrently for the same key. valueFn must not
+// call methods on the map, or it may deadlock.
+func (m *CMap[K, V]) LoadOrCompute(key K, valueFn func() V) (actual V, loaded bool) {
+	hash := m.hash(key)
+	var (
+		resize uint8
+		ok     bool
+	)
+	for {
+		n, b := m.getNodeAndBucket(hash)
+		actual, loaded, resize, ok = b.tryLoadOrCompute(m, n, hash, key, valueFn)
+		if ok {
+			m.written(n, resize)
 			return
 		}
 		runtime.Gosched()
@@ -76,19 +240,23 @@ func (m *CMap) LoadOrStore(key, value any) (actual any, loaded bool) {
 }
 
 // Delete deletes the value for a key.
-func (m *CMap) Delete(key any) {
+func (m *CMap[K, V]) Delete(key K) {
 	m.LoadAndDelete(key)
 }
 
 // LoadAndDelete deletes the value for a key, returning the previous value if any.
 // The loaded result reports whether the key was present.
-func (m *CMap) LoadAndDelete(key any) (value any, loaded bool) {
-	hash := chash(key)
-	var ok bool
+func (m *CMap[K, V]) LoadAndDelete(key K) (value V, loaded bool) {
+	hash := m.hash(key)
+	var (
+		resize uint8
+		ok     bool
+	)
 	for {
 		n, b := m.getNodeAndBucket(hash)
-		value, loaded, ok = b.tryLoadAndDelete(m, n, key)
+		value, loaded, resize, ok = b.tryLoadAndDelete(m, n, hash, key)
 		if ok {
+			m.written(n, resize)
 			return
 		}
 		runtime.Gosched()
@@ -105,52 +273,449 @@ func (m *CMap) LoadAndDelete(key any) (value any, loaded bool) {
 //
 // Range may be O(N) with the number of elements in the Cmap even if f returns
 // false after a constant number of calls.
-func (m *CMap) Range(f func(key, value any) bool) {
+//
+// Range copies each bucket into a buffer pooled by the CMap before calling f
+// for its entries, so f may call any method on the CMap, and repeated calls
+// do not allocate once the pool is warm.
+func (m *CMap[K, V]) Range(f func(key K, value V) bool) {
+	buf := m.getWalkBuf()
 	n := m.getNode()
 	for i := range n.buckets {
 		b := n.getBucket(uintptr(i))
-		if !b.walk(f) {
+		if !b.walk(buf, f) {
+			break
+		}
+	}
+	m.walks.Put(buf)
+}
+
+// ParallelRange calls f for each key and value present in the Cmap, using up
+// to workers goroutines that each walk a share of the buckets. If workers <= 0,
+// GOMAXPROCS goroutines are used. f may be called concurrently and must be
+// safe for that. If f returns false, all workers stop after their current
+// call and ParallelRange returns once they have.
+//
+// ParallelRange gives the same guarantees as Range: it walks the node current
+// at the start of the call, and if growWork replaces that node midway, the
+// remaining buckets still hold every entry that was present when they were
+// frozen, so no key present for the whole call is missed and none is visited
+// twice.
+func (m *CMap[K, V]) ParallelRange(workers int, f func(key K, value V) bool) {
+	n := m.getNode()
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(n.buckets) {
+		workers = len(n.buckets)
+	}
+
+	var (
+		next    int64
+		stopped uint32
+		wg      sync.WaitGroup
+	)
+	yield := func(key K, value V) bool {
+		if atomic.LoadUint32(&stopped) != 0 {
+			return false
+		}
+		if !f(key, value) {
+			atomic.StoreUint32(&stopped, 1)
+			return false
+		}
+		return true
+	}
+	work := func() {
+		buf := m.getWalkBuf()
+		for atomic.LoadUint32(&stopped) == 0 {
+			i := atomic.AddInt64(&next, 1) - 1
+			if i >= int64(len(n.buckets)) {
+				break
+			}
+			if !n.getBucket(uintptr(i)).walk(buf, yield) {
+				break
+			}
+		}
+		m.walks.Put(buf)
+	}
+
+	wg.Add(workers - 1)
+	for w := 1; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			work()
+		}()
+	}
+	work()
+	wg.Wait()
+}
+
+// Scan returns some of the entries of the Cmap, starting at cursor, and the
+// cursor to pass to the next call. A scan starts with cursor 0 and is complete
+// when the returned cursor is 0 again.
+//
+// count is a hint of how many entries to return: Scan returns whole buckets,
+// so it may return more, and fewer only when the scan completes. If count <= 0,
+// 10 is used.
+//
+// Like Redis SCAN, the cursor walks the bucket index with its bits reversed,
+// so nothing has to be held between calls: every key present for the whole
+// scan is returned at least once even if the Cmap grows or shrinks between
+// calls, though a key may be returned more than once after a shrink.
+func (m *CMap[K, V]) Scan(cursor uint64, count int) (entries []Entry[K, V], next uint64) {
+	if count <= 0 {
+		count = 10
+	}
+	n := m.getNode()
+	mask := uint64(n.mask)
+	for {
+		b := n.getBucket(uintptr(cursor & mask))
+		b.mu.RLock()
+		b.each(func(k K, v V) {
+			entries = append(entries, Entry[K, V]{Key: k, Value: v})
+		})
+		b.mu.RUnlock()
+
+		// Increment the reversed cursor: setting the bits above mask makes
+		// the carry run off the top once every bucket has been visited.
+		cursor |= ^mask
+		cursor = bits.Reverse64(cursor)
+		cursor++
+		cursor = bits.Reverse64(cursor)
+		if cursor == 0 || len(entries) >= count {
+			return entries, cursor
+		}
+	}
+}
+
+// Snapshot returns an immutable copy of the Cmap's contents at a single
+// point in time.
+//
+// Snapshot finishes any evacuation of the current node, then read-locks all
+// of its buckets, only long enough to take their entries and mark them
+// shared; if the node is replaced before all the locks are held, Snapshot
+// releases them and starts again with the new node. Nothing is copied under
+// the locks: the first write to a shared bucket copies its entries before
+// changing them, so the copy is made lazily, one bucket at a time, and
+// writers are blocked only for the time it takes to visit the buckets.
+func (m *CMap[K, V]) Snapshot() *Snapshot[K, V] {
+	n := m.rlockAll()
+	defer n.runlockAll()
+	s := &Snapshot[K, V]{
+		mask:   n.mask,
+		seed:   n.seed,
+		hasher: n.hasher,
+	}
+	if n.hasher == nil {
+		s.buckets = make([]map[K]V, len(n.buckets))
+	} else {
+		s.hbuckets = make([]map[uintptr][]Entry[K, V], len(n.buckets))
+	}
+	for i := range n.buckets {
+		b := &n.buckets[i]
+		s.count += b.len()
+		// Snapshots may mark b concurrently, as they hold b.mu for reading.
+		atomic.StoreUint32(&b.shared, 1)
+		if b.hasher == nil {
+			s.buckets[i] = b.m
+		} else {
+			s.hbuckets[i] = b.hm
+		}
+	}
+	return s
+}
+
+// Len returns the number of elements within the Cmap. Unlike Count, it is
+// exact: it locks all the buckets, like Snapshot, and counts their elements,
+// so it blocks writers for a time proportional to the number of buckets.
+func (m *CMap[K, V]) Len() int {
+	n := m.rlockAll()
+	defer n.runlockAll()
+	l := 0
+	for i := range n.buckets {
+		l += n.buckets[i].len()
+	}
+	return l
+}
+
+// rlockAll finishes any evacuation of the current node, read-locks all of
+// its buckets and returns it. Every write must then go through one of the
+// locked buckets, so the contents of the node are those of the Cmap until
+// runlockAll. If the node is replaced before all the locks are held,
+// rlockAll releases them and starts again with the new node.
+//
+// The evacuation is finished before any lock is taken, so that finish, which
+// notifies the observer, never runs while rlockAll holds some of the locks.
+func (m *CMap[K, V]) rlockAll() *node[K, V] {
+	for {
+		n := m.getNode()
+		n.evacuteAll()
+		for i := range n.buckets {
+			n.buckets[i].mu.RLock()
+		}
+		if atomic.LoadPointer(&m.node) == unsafe.Pointer(n) {
+			return n
+		}
+		n.runlockAll()
+	}
+}
+
+func (n *node[K, V]) runlockAll() {
+	for i := range n.buckets {
+		n.buckets[i].mu.RUnlock()
+	}
+}
+
+func (m *CMap[K, V]) getWalkBuf() *[]Entry[K, V] {
+	buf, _ := m.walks.Get().(*[]Entry[K, V])
+	if buf == nil {
+		buf = new([]Entry[K, V])
+	}
+	return buf
+}
+
+// Clear deletes all the entries, resulting in an empty CMap.
+//
+// Clear freezes every bucket of the current node, after finishing any
+// evacuation still in progress, and then atomically replaces the node with
+// a fresh initial one. Writers that hit a frozen bucket retry against the
+// new node, so no entry stored before Clear returns can survive it.
+func (m *CMap[K, V]) Clear() {
+	for {
+		n := m.getNode()
+		for i := range n.buckets {
+			n.getBucket(uintptr(i)).freeze()
+		}
+		// No write can succeed on n any more, so count is stable until
+		// the new node is published.
+		count := m.count.load()
+		if atomic.CompareAndSwapPointer(&m.node, unsafe.Pointer(n), unsafe.Pointer(newInitNode[K, V](m.config().initB, n.seed, n.hasher))) {
+			m.count.sub(count)
 			return
 		}
+		// growWork replaced n while we froze it, clear the new node.
+	}
+}
+
+// All returns an iterator over each key and value present in the Cmap.
+// It has the same guarantees as Range: no key is visited more than once.
+func (m *CMap[K, V]) All() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		m.Range(yield)
+	}
+}
+
+// Keys returns an iterator over each key present in the Cmap.
+// It has the same guarantees as Range: no key is visited more than once.
+func (m *CMap[K, V]) Keys() iter.Seq[K] {
+	return func(yield func(K) bool) {
+		m.Range(func(key K, _ V) bool {
+			return yield(key)
+		})
+	}
+}
+
+// Values returns an iterator over the value of each key present in the Cmap.
+// It has the same guarantees as Range: no key is visited more than once.
+func (m *CMap[K, V]) Values() iter.Seq[V] {
+	return func(yield func(V) bool) {
+		m.Range(func(_ K, value V) bool {
+			return yield(value)
+		})
+	}
+}
+
+// Reserve grows the Cmap, if needed, straight to the number of buckets that
+// can hold n elements without growing, instead of growing one step at a time
+// as they are stored. As the elements do not spread evenly over the buckets,
+// it leaves room for the fullest bucket: short of a chance of about 1 in 1000,
+// storing n elements does not grow the map again. The map grows to no more
+// than 1<<31 buckets. If a resize is already in progress, Reserve helps to
+// finish it first. If wait is true, Reserve returns only once the evacuation
+// to the new buckets has completed.
+func (m *CMap[K, V]) Reserve(n int, wait bool) {
+	for {
+		nd := m.getNode()
+		B := min(m.config().sizeFor(int64(n), nd.B), mMaxBit)
+		if B <= nd.B {
+			break
+		}
+		if nd.growing() {
+			nd.evacuteAll()
+			runtime.Gosched()
+			continue
+		}
+		if !growWork(m, nd, B) {
+			// Another goroutine is installing a node, or Clear replaced nd.
+			runtime.Gosched()
+		}
+	}
+	m.evacuteWork()
+	if wait {
+		m.WaitResize(context.Background())
+	}
+}
+
+// Compact shrinks the Cmap, if possible, straight to the smallest number of
+// buckets that can hold its current elements, but never below its initial
+// size. It shrinks even if the map was created WithoutShrink. If a resize is
+// already in progress, Compact helps to finish it first. If wait is true,
+// Compact returns only once the evacuation to the new buckets has completed.
+func (m *CMap[K, V]) Compact(wait bool) {
+	for {
+		nd := m.getNode()
+		c := m.config()
+		B := c.sizeFor(m.count.sum(), c.initB)
+		if B >= nd.B {
+			break
+		}
+		if nd.growing() {
+			nd.evacuteAll()
+			runtime.Gosched()
+			continue
+		}
+		if !growWork(m, nd, B) {
+			// Another goroutine is installing a node, or Clear replaced nd.
+			runtime.Gosched()
+		}
+	}
+	m.evacuteWork()
+	if wait {
+		m.WaitResize(context.Background())
+	}
+}
+
+// WaitResize returns once the Cmap is not resizing, or with ctx.Err() if ctx
+// is done first. It helps to evacuate the current node, so it also completes
+// an incremental evacuation that no write is driving.
+func (m *CMap[K, V]) WaitResize(ctx context.Context) error {
+	for {
+		n := m.getNode()
+		if atomic.LoadUint32(&n.resize) == 0 {
+			return nil
+		}
+		for i := range n.buckets {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			n.getBucket(uintptr(i))
+		}
+		if n.done == nil {
+			// growWork is replacing n.
+			runtime.Gosched()
+			continue
+		}
+		select {
+		case <-n.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// evacuteWork does the evacution owed by a write to the Cmap in the
+// incremental and sync evacute modes. It must not be called with a bucket
+// locked.
+func (m *CMap[K, V]) evacuteWork() {
+	switch m.config().evacute {
+	case EvacuateIncremental:
+		if n := m.getNode(); n.growing() {
+			n.evacuteSome(evacuteStep)
+		}
+	case EvacuateSync:
+		if n := m.getNode(); n.growing() {
+			n.evacuteAll()
+		}
 	}
 }
 
 // Count returns the number of elements within the Cmap.
-func (m *CMap) Count() int64 {
-	return atomic.LoadInt64(&m.count)
+//
+// Count is cheap and never blocks, but it is approximate while the Cmap is
+// being modified: it sums a striped counter without stopping the writers,
+// and is only exact once all operations have returned. Use Len for an exact
+// number.
+func (m *CMap[K, V]) Count() int64 {
+	return m.count.sum()
+}
+
+// added counts a key of hash stored in a bucket of n, which then holds blen
+// elements, and returns the B to resize n to, or 0 if it need not grow.
+// The count of the key's cell decides whether to grow, and only then is the
+// exact count summed to confirm it.
+//
+// added is called with the bucket locked, so the resize is left to written,
+// once the lock is released: it notifies the observer, which may use the map.
+func (m *CMap[K, V]) added(n *node[K, V], hash uintptr, blen int) (resize uint8) {
+	count := m.count.add(hash, 1)
+	c := m.config()
+	if c.needGrow(int64(blen), count, n.B) && c.needGrow(int64(blen), m.count.sum(), n.B) {
+		return n.B + 1
+	}
+	return 0
 }
 
-func (m *CMap) getNodeAndBucket(hash uintptr) (n *node, b *bucket) {
+// deleted counts a key of hash deleted from a bucket of n, and returns the
+// B to shrink n to, or 0 if it need not shrink, as added does.
+func (m *CMap[K, V]) deleted(n *node[K, V], hash uintptr) (resize uint8) {
+	count := m.count.add(hash, -1)
+	c := m.config()
+	if c.needShrink(count, n.B) && c.needShrink(m.count.sum(), n.B) {
+		return n.B - 1
+	}
+	return 0
+}
+
+// written finishes a write to a bucket of n, once its lock is released:
+// it resizes n to 1<<resize buckets, unless resize is 0, and does the
+// evacution owed by the write.
+func (m *CMap[K, V]) written(n *node[K, V], resize uint8) {
+	if resize != 0 {
+		growWork(m, n, resize)
+	}
+	m.evacuteWork()
+}
+
+// hash returns the hash of key under the seed of m.
+func (m *CMap[K, V]) hash(key K) uintptr {
+	return m.getNode().hash(key)
+}
+
+// hash returns the hash of key under the seed and hasher of n.
+func (n *node[K, V]) hash(key K) uintptr {
+	if n.hasher != nil {
+		return uintptr(n.hasher.Hash(n.seed.seed, key))
+	}
+	return chash(key, n.seed)
+}
+
+func (m *CMap[K, V]) getNodeAndBucket(hash uintptr) (n *node[K, V], b *bucket[K, V]) {
 	n = m.getNode()
 	b = n.getBucket(hash)
 	return n, b
 }
 
-func (m *CMap) getNode() *node {
+func (m *CMap[K, V]) getNode() *node[K, V] {
 	for {
-		n := (*node)(atomic.LoadPointer(&m.node))
+		n := (*node[K, V])(atomic.LoadPointer(&m.node))
 		if n != nil {
 			return n
 		}
 		// node == nil, init node.
-		newNode := &node{
-			mask:    uintptr(mInitSize - 1),
-			B:       mInitBit,
-			buckets: make([]bucket, mInitSize),
-		}
+		h, _ := m.config().hasher.(Hasher[K])
+		newNode := newInitNode[K, V](m.config().initB, newSeed[K](), h)
 		if atomic.CompareAndSwapPointer(&m.node, nil, unsafe.Pointer(newNode)) {
 			return newNode
 		}
 	}
-	// n := (*node)(atomic.LoadPointer(&m.node))
+	// n := (*node[K, V])(atomic.LoadPointer(&m.node))
 	// if n == nil {
 	// 	m.mu.Lock()
-	// 	n = (*node)(atomic.LoadPointer(&m.node))
+	// 	n = (*node[K, V])(atomic.LoadPointer(&m.node))
 	// 	if n == nil {
-	// 		n = &node{
+	// 		n = &node[K, V]{
 	// 			mask:    uintptr(mInitSize - 1),
 	// 			B:       mInitBit,
-	// 			buckets: make([]bucket, mInitSize),
+	// 			buckets: make([]bucket[K, V], mInitSize),
 	// 		}
 	// 		atomic.StorePointer(&m.node, unsafe.Pointer(n))
 	// 	}
@@ -159,211 +724,468 @@ func (m *CMap) getNode() *node {
 	// return n
 }
 
+func newInitNode[K comparable, V any](B uint8, seed hashSeed, h Hasher[K]) *node[K, V] {
+	return &node[K, V]{
+		mask:    bucketMask(B),
+		B:       B,
+		buckets: make([]bucket[K, V], bucketShift(B)),
+		seed:    seed,
+		hasher:  h,
+	}
+}
+
+func (m *CMap[K, V]) config() *config {
+	if m.cfg != nil {
+		return m.cfg
+	}
+	return &defaultConfig
+}
+
 // give a hash key and return it's store bucket
-func (n *node) getBucket(i uintptr) *bucket {
+func (n *node[K, V]) getBucket(i uintptr) *bucket[K, V] {
 	i = i & n.mask
 	b := &(n.buckets[i])
-	b.onceInit()
-	oldNode := (*node)(atomic.LoadPointer(&n.oldNode))
-	if oldNode != nil && !b.hadEvacuted() {
-		evacute(n, oldNode, b, i)
+	b.onceInit(n.hasher)
+	oldNode := (*node[K, V])(atomic.LoadPointer(&n.oldNode))
+	if oldNode != nil && !b.hadEvacuted() && evacute(n, oldNode, b, i) {
+		n.finish(oldNode)
 	}
 	return b
 }
 
-func (n *node) initBuckets() {
+func (n *node[K, V]) initBuckets() {
+	n.evacuteAll()
+}
+
+// evacuteAll evacutes every bucket of n that has not been evacuted yet.
+func (n *node[K, V]) evacuteAll() {
 	for i := range n.buckets {
 		n.getBucket(uintptr(i))
 	}
-	// empty oldNode
-	atomic.StorePointer(&n.oldNode, nil)
-	// finish all evacute
-	atomic.StoreUint32(&n.resize, 0)
+}
+
+// evacuteSome evacutes up to k of the buckets of n, in order.
+func (n *node[K, V]) evacuteSome(k int) {
+	for ; k > 0; k-- {
+		i := atomic.AddUint32(&n.next, 1) - 1
+		if int(i) >= len(n.buckets) {
+			return
+		}
+		n.getBucket(uintptr(i))
+	}
 }
 
 // evacute oldNode -> newNode
 // i must be b==new.buckuts[i&n.mask]
-func evacute(new, old *node, b *bucket, i uintptr) {
+//
+// Every access to the entries of b and b.frozen holds b.mu. A write locks its bucket and,
+// if the bucket is frozen, gives up to retry against the current node, while
+// evacute freezes an old bucket and copies it out under that same lock. So a
+// write to an old bucket either happens before the freeze and is copied, or
+// sees the freeze and is redone on the new node: no entry is lost, and none
+// deleted before the copy comes back. A frozen bucket never changes again,
+// so reads may still use it; its contents were current during their call.
+// It reports whether b was the last bucket of new to evacute.
+func evacute[K comparable, V any](new, old *node[K, V], b *bucket[K, V], i uintptr) (last bool) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	if b.hadEvacuted() || old == nil {
-		return
+		return false
 	}
+	moved := b.len()
 	if new.mask > old.mask {
 		// grow
 		pb := old.getBucket(i)
-		pb.freezeInLock(func(k, v any) bool {
-			h := chash(k)
-			if h&new.mask == i {
-				b.m[k] = v
+		pb.freezeInLock(func() {
+			if pb.hasher != nil {
+				for h, es := range pb.hm {
+					if h&new.mask == i {
+						b.insert(h, es)
+					}
+				}
+				return
+			}
+			for k, v := range pb.m {
+				if new.hash(k)&new.mask == i {
+					b.m[k] = v
+				}
 			}
-			return true
 		})
 	} else {
-		// shrink
-		pb0 := old.getBucket(i)
-		pb1 := old.getBucket(i + bucketShift(new.B))
-		pb0.freezeInLock(func(k, v any) bool {
-			b.m[k] = v
-			return true
-		})
-		pb1.freezeInLock(func(k, v any) bool {
-			b.m[k] = v
-			return true
-		})
+		// shrink, possibly by more than one step when compacting
+		for j := i; j <= old.mask; j += bucketShift(new.B) {
+			pb := old.getBucket(j)
+			pb.freezeInLock(func() {
+				for h, es := range pb.hm {
+					b.insert(h, es)
+				}
+				for k, v := range pb.m {
+					b.m[k] = v
+				}
+			})
+		}
 	}
+	atomic.AddInt64(&new.moved, int64(b.len()-moved))
 	atomic.StoreUint32(&b.evacuted, uint32JodDone)
+	return new.evacuted()
+}
+
+// evacuted counts down n.left, reporting whether it hit zero, after which
+// the resize to n must be finished by calling finish.
+func (n *node[K, V]) evacuted() bool {
+	return atomic.AddInt64(&n.left, -1) == 0
 }
 
-func (b *bucket) onceInit() {
+// finish all evacute from old to n.
+// n keeps resize set until the observer has returned, so resizes of a map
+// are reported one at a time.
+func (n *node[K, V]) finish(old *node[K, V]) {
+	atomic.StorePointer(&n.oldNode, nil)
+	n.owner.resizeFinished(n, old)
+	atomic.StoreUint32(&n.resize, 0)
+	close(n.done)
+}
+
+func (b *bucket[K, V]) onceInit(h Hasher[K]) {
 	b.init.Do(func() {
-		b.m = make(map[any]any)
+		if h != nil {
+			b.hasher = h
+			b.hm = make(map[uintptr][]Entry[K, V])
+		} else {
+			b.m = make(map[K]V)
+		}
 	})
 }
 
-func (b *bucket) hadEvacuted() bool {
-	return atomic.LoadUint32(&b.evacuted) == uint32JodDone
+// get returns the value stored in b for key, found by its hash under the
+// hasher of b, if any.
+// b.mu must be held.
+func (b *bucket[K, V]) get(hash uintptr, key K) (value V, ok bool) {
+	if b.hasher == nil {
+		value, ok = b.m[key]
+		return
+	}
+	es := b.hm[hash]
+	if i := findEntry(b.hasher, es, key); i >= 0 {
+		return es[i].Value, true
+	}
+	return value, false
 }
 
-func (b *bucket) hadFrozen() bool {
-	return atomic.LoadUint32(&b.frozen) == uint32JodDone
+// own copies the entries of b, if a Snapshot holds them, so that b can be
+// changed without changing the snapshot.
+// b.mu must be held for writing.
+func (b *bucket[K, V]) own() {
+	if atomic.LoadUint32(&b.shared) == 0 {
+		return
+	}
+	if b.hasher == nil {
+		b.m = maps.Clone(b.m)
+	} else {
+		hm := make(map[uintptr][]Entry[K, V], len(b.hm))
+		for h, es := range b.hm {
+			hm[h] = slices.Clone(es)
+		}
+		b.hm = hm
+	}
+	atomic.StoreUint32(&b.shared, 0)
 }
 
-func (b *bucket) freezeInLock(f func(k, v any) bool) (done bool) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	atomic.StoreUint32(&b.frozen, uint32JodDone)
+// put stores value for key, and reports whether key was added to b.
+// b.mu must be held for writing.
+func (b *bucket[K, V]) put(hash uintptr, key K, value V) (added bool) {
+	b.own()
+	if b.hasher == nil {
+		l0 := len(b.m) // Using length check existence is faster than accessing.
+		b.m[key] = value
+		return len(b.m) != l0
+	}
+	es := b.hm[hash]
+	if i := findEntry(b.hasher, es, key); i >= 0 {
+		es[i].Value = value
+		return false
+	}
+	b.hm[hash] = append(es, Entry[K, V]{Key: key, Value: value})
+	b.hn++
+	return true
+}
 
-	// BUG issue001 b.m race with delete(b.m,key)
-	for k, v := range b.m {
-		if !f(k, v) {
-			return false
+// remove deletes key from b, and returns its value if it was present.
+// b.mu must be held for writing.
+func (b *bucket[K, V]) remove(hash uintptr, key K) (value V, ok bool) {
+	if b.hasher == nil {
+		if value, ok = b.m[key]; ok {
+			b.own()
+			delete(b.m, key)
 		}
+		return
 	}
-	return true
+	i := findEntry(b.hasher, b.hm[hash], key)
+	if i < 0 {
+		return value, false
+	}
+	b.own()
+	es := b.hm[hash]
+	value = es[i].Value
+	if len(es) == 1 {
+		delete(b.hm, hash)
+	} else {
+		es[i] = es[len(es)-1]
+		es[len(es)-1] = Entry[K, V]{}
+		b.hm[hash] = es[:len(es)-1]
+	}
+	b.hn--
+	return value, true
+}
+
+// insert adds the entries es of hash, none of whose keys is in b, to b,
+// which has a hasher. es is copied, as it belongs to a frozen bucket that
+// readers may still use.
+// b.mu must be held for writing.
+func (b *bucket[K, V]) insert(hash uintptr, es []Entry[K, V]) {
+	b.own()
+	b.hm[hash] = append(b.hm[hash], es...)
+	b.hn += len(es)
 }
 
-func (b *bucket) walk(f func(k, v any) bool) (done bool) {
-	// use in range
-	type entry struct {
-		key, value any
+// len returns the number of entries of b.
+// b.mu must be held.
+func (b *bucket[K, V]) len() int {
+	if b.hasher == nil {
+		return len(b.m)
 	}
-	b.mu.Lock()
-	entries := make([]entry, 0, len(b.m))
-	for k, v := range b.m {
-		entries = append(entries, entry{key: k, value: v})
+	return b.hn
+}
+
+// each calls f for each entry of b.
+// b.mu must be held.
+func (b *bucket[K, V]) each(f func(k K, v V)) {
+	if b.hasher == nil {
+		for k, v := range b.m {
+			f(k, v)
+		}
+		return
 	}
+	for _, es := range b.hm {
+		for _, e := range es {
+			f(e.Key, e.Value)
+		}
+	}
+}
+
+func (b *bucket[K, V]) hadEvacuted() bool {
+	return atomic.LoadUint32(&b.evacuted) == uint32JodDone
+}
+
+func (b *bucket[K, V]) freeze() {
+	b.mu.Lock()
+	b.frozen = true
 	b.mu.Unlock()
+}
+
+// freezeInLock freezes b and calls f, which copies out its entries, under
+// the same lock, so that no write can land in b after it was copied.
+func (b *bucket[K, V]) freezeInLock(f func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.frozen = true
+	f()
+}
 
+// walk copies the entries of b into *buf and calls f for each of them
+// after releasing the lock, so f may call any method on the map.
+// *buf is reused between buckets and left empty on return.
+func (b *bucket[K, V]) walk(buf *[]Entry[K, V], f func(k K, v V) bool) (done bool) {
+	entries := (*buf)[:0]
+	b.mu.RLock()
+	b.each(func(k K, v V) {
+		entries = append(entries, Entry[K, V]{Key: k, Value: v})
+	})
+	b.mu.RUnlock()
+
+	done = true
 	for _, e := range entries {
-		if !f(e.key, e.value) {
-			return false
+		if !f(e.Key, e.Value) {
+			done = false
+			break
 		}
 	}
-	return true
+	// Drop the references so that pooled buffers do not keep keys and values alive.
+	clear(entries)
+	*buf = entries[:0]
+	return done
 }
 
-func (b *bucket) tryLoad(key any) (value any, ok bool) {
+func (b *bucket[K, V]) tryLoad(hash uintptr, key K) (value V, ok bool) {
 	b.mu.RLock()
-	value, ok = b.m[key]
+	value, ok = b.get(hash, key)
 	b.mu.RUnlock()
 	return
 }
 
-func (b *bucket) tryStore(m *CMap, n *node, key, value any) bool {
+func (b *bucket[K, V]) tryStore(m *CMap[K, V], n *node[K, V], hash uintptr, key K, value V) (resize uint8, ok bool) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	if b.hadFrozen() {
-		return false
+	if b.frozen {
+		return 0, false
 	}
+	if !b.put(hash, key, value) {
+		return 0, true
+	}
+	return m.added(n, hash, b.len()), true
+}
 
-	l0 := len(b.m) // Using length check existence is faster than accessing.
-	b.m[key] = value
-	l1 := len(b.m)
-	if l0 == l1 {
-		return true
+func (b *bucket[K, V]) tryLoadOrStore(m *CMap[K, V], n *node[K, V], hash uintptr, key K, value V) (actual V, loaded bool, resize uint8, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.frozen {
+		return actual, false, 0, false
 	}
-	count := atomic.AddInt64(&m.count, 1)
-	// grow
-	if overLoadFactor(int64(l1), n.B) || overflowGrow(count, n.B) {
-		growWork(m, n, n.B+1)
+	actual, loaded = b.get(hash, key)
+	if loaded {
+		return actual, loaded, 0, true
 	}
-	return true
+	b.put(hash, key, value)
+	return value, false, m.added(n, hash, b.len()), true
 }
 
-func (b *bucket) tryLoadOrStore(m *CMap, n *node, key, value any) (actual any, loaded, ok bool) {
+func (b *bucket[K, V]) tryLoadOrCompute(m *CMap[K, V], n *node[K, V], hash uintptr, key K, valueFn func() V) (actual V, loaded bool, resize uint8, ok bool) {
+	if actual, loaded = b.tryLoad(hash, key); loaded {
+		return actual, loaded, 0, true
+	}
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	if b.hadFrozen() {
-		return nil, false, false
+	if b.frozen {
+		return actual, false, 0, false
 	}
-	actual, loaded = b.m[key]
+	actual, loaded = b.get(hash, key)
 	if loaded {
-		return actual, loaded, true
+		return actual, loaded, 0, true
 	}
-	b.m[key] = value
-	count := atomic.AddInt64(&m.count, 1)
+	actual = valueFn()
+	b.put(hash, key, actual)
+	return actual, false, m.added(n, hash, b.len()), true
+}
 
-	// grow
-	if overLoadFactor(int64(len(b.m)), n.B) || overflowGrow(count, n.B) {
-		growWork(m, n, n.B+1)
+func (b *bucket[K, V]) tryLoadAndDelete(m *CMap[K, V], n *node[K, V], hash uintptr, key K) (actual V, loaded bool, resize uint8, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.frozen {
+		return actual, false, 0, false
 	}
-	return value, false, true
+	actual, loaded = b.remove(hash, key)
+	if !loaded {
+		return actual, false, 0, true
+	}
+	return actual, loaded, m.deleted(n, hash), true
 }
 
-func (b *bucket) tryLoadAndDelete(m *CMap, n *node, key any) (actual any, loaded, ok bool) {
-	if b.hadFrozen() {
-		return nil, false, false
+func (b *bucket[K, V]) trySwap(m *CMap[K, V], n *node[K, V], hash uintptr, key K, value V) (previous V, loaded bool, resize uint8, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.frozen {
+		return previous, false, 0, false
+	}
+	previous, loaded = b.get(hash, key)
+	b.put(hash, key, value)
+	if loaded {
+		return previous, loaded, 0, true
 	}
+	return previous, false, m.added(n, hash, b.len()), true
+}
+
+func (b *bucket[K, V]) tryCompareAndSwap(hash uintptr, key K, old, new V) (swapped, ok bool) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	if b.hadFrozen() {
-		return nil, false, false
+	if b.frozen {
+		return false, false
 	}
-	actual, loaded = b.m[key]
-	if !loaded {
-		return nil, false, true
+	value, loaded := b.get(hash, key)
+	if !loaded || any(value) != any(old) {
+		return false, true
 	}
+	b.put(hash, key, new)
+	return true, true
+}
 
-	// BUG issue001 b.m race with delete(b.m,key)
-	delete(b.m, key)
-	count := atomic.AddInt64(&m.count, -1)
+func (b *bucket[K, V]) tryCompareAndDelete(m *CMap[K, V], n *node[K, V], hash uintptr, key K, old V) (deleted bool, resize uint8, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.frozen {
+		return false, 0, false
+	}
+	value, loaded := b.get(hash, key)
+	if !loaded || any(value) != any(old) {
+		return false, 0, true
+	}
+	b.remove(hash, key)
+	return true, m.deleted(n, hash), true
+}
 
-	// shrink
-	if belowShrink(count, n.B) {
-		growWork(m, n, n.B-1)
+func (b *bucket[K, V]) tryCompute(m *CMap[K, V], n *node[K, V], hash uintptr, key K, f func(V, bool) (V, ComputeOp)) (actual V, loaded bool, resize uint8, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.frozen {
+		return actual, false, 0, false
 	}
-	return actual, loaded, true
+	old, loaded := b.get(hash, key)
+	new, op := f(old, loaded)
+	switch op {
+	case ComputeUpdate:
+		b.put(hash, key, new)
+		if loaded {
+			return new, true, 0, true
+		}
+		return new, true, m.added(n, hash, b.len()), true
+	case ComputeDelete:
+		if !loaded {
+			return actual, false, 0, true
+		}
+		b.remove(hash, key)
+		return actual, false, m.deleted(n, hash), true
+	}
+	return old, loaded, 0, true
 }
 
-func growWork(m *CMap, n *node, B uint8) {
+// growWork starts a resize of n to 1<<B buckets, unless n is already
+// resizing or replaced. It reports whether it installed the new node.
+func growWork[K comparable, V any](m *CMap[K, V], n *node[K, V], B uint8) (installed bool) {
 	if !n.growing() && atomic.CompareAndSwapUint32(&n.resize, 0, 1) {
-		for {
-			nn := &node{
-				mask:    bucketMask(B),
-				B:       B,
-				resize:  1,
-				oldNode: unsafe.Pointer(n),
-				buckets: make([]bucket, bucketShift(B)),
-			}
-			if atomic.CompareAndSwapPointer(&m.node, unsafe.Pointer(n), unsafe.Pointer(nn)) {
-				go nn.initBuckets()
-				return
-			}
+		nn := &node[K, V]{
+			mask:    bucketMask(B),
+			B:       B,
+			resize:  1,
+			oldNode: unsafe.Pointer(n),
+			buckets: make([]bucket[K, V], bucketShift(B)),
+			seed:    n.seed,
+			hasher:  n.hasher,
+			left:    int64(bucketShift(B)) + 1, // +1 until resizeStarted returns
+			done:    make(chan struct{}),
+			owner:   m,
+			start:   time.Now(),
+		}
+		// n may have been replaced by Clear, in which case it keeps
+		// resize set and is never grown again.
+		if !atomic.CompareAndSwapPointer(&m.node, unsafe.Pointer(n), unsafe.Pointer(nn)) {
+			return false
+		}
+		m.resizeStarted(nn, n)
+		if nn.evacuted() {
+			nn.finish(n)
+			return true
 		}
+		if m.config().evacute == EvacuateBackground {
+			go nn.initBuckets()
+		}
+		return true
 	}
+	return false
 }
 
-func (n *node) growing() bool {
+func (n *node[K, V]) growing() bool {
 	return atomic.LoadPointer(&n.oldNode) != nil
 }
 
-// buckut len over loadfactor
-func overLoadFactor(blen int64, B uint8) bool {
-	// TODO adjust loadfactor
-	return blen*13/2 > int64(1<<(B)) && B < 31
-}
-
 // count overflow grow threshold
 func overflowGrow(count int64, B uint8) bool {
 	if B > 31 {
@@ -7,6 +7,7 @@ package cmap_test
 import (
 	"fmt"
 	"reflect"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -24,8 +25,8 @@ func benchMap(b *testing.B, bench bench) {
 		// &DeepCopyMap{},
 		// &RWMutexMap{},
 		&sync.Map{},
-		&cmap.CMap{},
-		&cmap.FMap{},
+		&cmap.CMap[any, any]{},
+		&cmap.FMap[any, any]{},
 	} {
 		b.Run(fmt.Sprintf("%T", m), func(b *testing.B) {
 			m = reflect.New(reflect.TypeOf(m).Elem()).Interface().(mapInterface)
@@ -295,3 +296,65 @@ func BenchmarkDeleteCollision(b *testing.B) {
 		},
 	})
 }
+
+// BenchmarkStoreDeleteDisjoint has every goroutine insert and delete keys of
+// its own, so the goroutines contend on nothing but the element count. Run
+// it with a high -cpu to see the effect of the striped count.
+func BenchmarkStoreDeleteDisjoint(b *testing.B) {
+	benchMap(b, bench{
+		perG: func(b *testing.B, pb *testing.PB, i int, m mapInterface) {
+			for ; pb.Next(); i++ {
+				m.Store(i, i)
+				m.Delete(i)
+			}
+		},
+	})
+}
+
+// BenchmarkHasher loads and swaps composite keys, whose identity is a small
+// part of a long value, in maps that hash and compare the whole key and in
+// maps with a Hasher of the identity only.
+func BenchmarkHasher(b *testing.B) {
+	const mapSize = 1 << 10
+	agent := strings.Repeat("Mozilla/5.0 (X11; Linux x86_64) ", 8)
+	keys := make([]session, mapSize)
+	for i := range keys {
+		keys[i] = session{i % 7, i, agent}
+	}
+
+	newCMap := func(opts ...cmap.Option) cmap.Interface[session, int] {
+		m, err := cmap.NewCMapWithOptions[session, int](opts...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return m
+	}
+	for _, bm := range []struct {
+		name string
+		m    cmap.Interface[session, int]
+	}{
+		{"CMap", newCMap()},
+		{"CMapHasher", newCMap(cmap.WithHasher[session](sessionHasher{}))},
+		{"FMap", cmap.NewFMap[session, int](0)},
+		{"FMapHasher", cmap.NewFMapWithHasher[session, int](0, sessionHasher{})},
+	} {
+		m := bm.m
+		for i, k := range keys {
+			m.Store(k, i)
+		}
+		b.Run(bm.name+"/Load", func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					m.Load(keys[i&(mapSize-1)])
+				}
+			})
+		})
+		b.Run(bm.name+"/Swap", func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					m.Swap(keys[i&(mapSize-1)], i)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,506 @@
+package cmap
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestNewCMapWithOptions(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts []Option
+	}{
+		{"negative capacity", []Option{WithInitialCapacity(-1)}},
+		{"huge capacity", []Option{WithInitialCapacity(math.MaxInt)}},
+		{"zero load factor", []Option{WithLoadFactor(0)}},
+		{"nil grow threshold", []Option{WithGrowThreshold(nil)}},
+		{"nil shrink threshold", []Option{WithShrinkThreshold(nil)}},
+	} {
+		if _, err := NewCMapWithOptions[int, int](tt.opts...); err == nil {
+			t.Errorf("%s: NewCMapWithOptions did not fail", tt.name)
+		}
+	}
+
+	const capacity = 1 << 16
+	m, err := NewCMapWithOptions[int, int](WithInitialCapacity(capacity), WithoutShrink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := m.getNode()
+	for i := 0; i < capacity; i++ {
+		m.Store(i, i)
+	}
+	if m.getNode() != n {
+		t.Errorf("map sized for %v elements grew while storing them", capacity)
+	}
+	for i := 0; i < capacity; i++ {
+		m.Delete(i)
+	}
+	if m.getNode() != n {
+		t.Errorf("map created WithoutShrink shrank")
+	}
+
+	// A capacity at which the average bucket is at the load factor,
+	// 4^B/6.5, must leave room for the fullest bucket.
+	for B := 8; B <= 11; B++ {
+		capacity := int(float64(int(1)<<(2*B)) / defaultConfig.loadFactor)
+		m, err := NewCMapWithOptions[int, int](WithInitialCapacity(capacity))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < capacity; i++ {
+			m.Store(i, i)
+		}
+		m.WaitResize(context.Background())
+		if grows := m.ResizeStats().Grows; grows != 0 {
+			t.Errorf("map sized for %v elements grew %v times while storing them", capacity, grows)
+		}
+	}
+
+	m, err = NewCMapWithOptions[int, int](
+		WithLoadFactor(1),
+		WithGrowThreshold(func(count int64, B uint8) bool { return count > 1<<B }),
+		WithShrinkThreshold(func(count int64, B uint8) bool { return count < 1<<(B-2) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1<<12; i++ {
+		m.Store(i, i)
+		m.WaitResize(context.Background())
+	}
+	B := m.getNode().B
+	if B != 12 {
+		t.Errorf("B = %v after storing 1<<12 elements, want 12", B)
+	}
+	for i := 0; i < 1<<12-1<<8; i++ {
+		m.Delete(i)
+		m.WaitResize(context.Background())
+	}
+	if B := m.getNode().B; B != 10 {
+		t.Errorf("B = %v after deleting down to 1<<8 elements, want 10", B)
+	}
+}
+
+func TestReserveAndCompact(t *testing.T) {
+	const mapSize = 1 << 16
+
+	var m CMap[int, int]
+	for i := 0; i < 1<<8; i++ {
+		m.Store(i, i)
+	}
+	m.Reserve(mapSize, true)
+	n := m.getNode()
+	if want := defaultConfig.sizeFor(mapSize, mInitBit); n.B != want {
+		t.Fatalf("B = %v after Reserve(%v), want %v", n.B, mapSize, want)
+	}
+	if atomic.LoadUint32(&n.resize) != 0 {
+		t.Fatalf("Reserve(%v, true) returned before the evacuation completed", mapSize)
+	}
+	for i := 0; i < mapSize; i++ {
+		m.Store(i, i)
+	}
+	if m.getNode() != n {
+		t.Fatalf("map reserved for %v elements grew while storing them", mapSize)
+	}
+
+	// The elements do not spread evenly, so a map reserved for a count at
+	// which the average bucket is at or just below the load factor, 4^B/6.5,
+	// must have room for the fullest bucket.
+	for B := 8; B <= 11; B++ {
+		for _, f := range []float64{1, 0.9} {
+			count := int(f * float64(int(1)<<(2*B)) / defaultConfig.loadFactor)
+			var m CMap[int, int]
+			m.Reserve(count, true)
+			grows := m.ResizeStats().Grows
+			for i := 0; i < count; i++ {
+				m.Store(i, i)
+			}
+			m.WaitResize(context.Background())
+			if got := m.ResizeStats().Grows; got != grows {
+				t.Fatalf("map reserved for %v elements grew %v times while storing them", count, got-grows)
+			}
+		}
+	}
+
+	// Reserving less than the current size does nothing.
+	m.Reserve(1, true)
+	if m.getNode() != n {
+		t.Fatalf("Reserve(1) resized the map")
+	}
+
+	m2, err := NewCMapWithOptions[int, int](WithoutShrink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < mapSize; i++ {
+		m2.Store(i, i)
+	}
+	for i := 1 << 6; i < mapSize; i++ {
+		m2.Delete(i)
+	}
+	m2.WaitResize(context.Background())
+	m2.Compact(true)
+	if B, want := m2.getNode().B, defaultConfig.sizeFor(1<<6, mInitBit); B != want {
+		t.Fatalf("B = %v after Compact, want %v", B, want)
+	}
+	for i := 0; i < 1<<6; i++ {
+		if v, ok := m2.Load(i); !ok || v != i {
+			t.Fatalf("Load(%v) after Compact = %v, %v, want %v, true", i, v, ok, i)
+		}
+	}
+	if got := m2.Count(); got != 1<<6 {
+		t.Fatalf("Count() after Compact = %v, want %v", got, 1<<6)
+	}
+
+	// Compact shrinks the map even when it races with other calls to grow
+	// or shrink it.
+	m2.Reserve(mapSize, true)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m2.Compact(true)
+		}()
+	}
+	wg.Wait()
+	if B, want := m2.getNode().B, defaultConfig.sizeFor(1<<6, mInitBit); B != want {
+		t.Fatalf("B = %v after concurrent Compact, want %v", B, want)
+	}
+}
+
+// TestSnapshotCopyOnWrite checks that Snapshot copies nothing while it holds
+// the locks of a large map, and that a Store right after it only copies the
+// bucket it writes to, leaving the snapshot as it was.
+func TestSnapshotCopyOnWrite(t *testing.T) {
+	const mapSize = 1 << 16
+
+	var m CMap[int, int]
+	for i := 0; i < mapSize; i++ {
+		m.Store(i, i)
+	}
+	m.WaitResize(context.Background())
+	s := m.Snapshot()
+	n := m.getNode()
+	for i := range n.buckets {
+		b := &n.buckets[i]
+		if !b.mu.TryLock() {
+			t.Fatalf("bucket %v still locked after Snapshot returned", i)
+		}
+		if reflect.ValueOf(b.m).UnsafePointer() != reflect.ValueOf(s.buckets[i]).UnsafePointer() {
+			t.Fatalf("Snapshot copied bucket %v instead of sharing it", i)
+		}
+		b.mu.Unlock()
+	}
+
+	for i := 0; i < mapSize; i++ {
+		m.Store(i, -i)
+	}
+	for i := range n.buckets {
+		if reflect.ValueOf(n.buckets[i].m).UnsafePointer() == reflect.ValueOf(s.buckets[i]).UnsafePointer() {
+			t.Fatalf("Store wrote to bucket %v without copying it from the snapshot", i)
+		}
+	}
+	for i := 0; i < mapSize; i++ {
+		if v, ok := s.Load(i); !ok || v != i {
+			t.Fatalf("Snapshot Load(%v) = %v, %v after Store(%v, %v), want %v, true", i, v, ok, i, -i, i)
+		}
+	}
+
+	// A bucket is copied once per snapshot, not once per write.
+	hash := m.hash(0)
+	b := n.getBucket(hash)
+	b.mu.RLock()
+	before := reflect.ValueOf(b.m).UnsafePointer()
+	b.mu.RUnlock()
+	m.Store(0, 1)
+	b.mu.RLock()
+	after := reflect.ValueOf(b.m).UnsafePointer()
+	b.mu.RUnlock()
+	if before != after {
+		t.Fatalf("Store copied a bucket no snapshot holds")
+	}
+}
+
+func TestEvacuateMode(t *testing.T) {
+	const mapSize = 1 << 14
+
+	for name, mode := range map[string]EvacuateMode{
+		"Background":  EvacuateBackground,
+		"Incremental": EvacuateIncremental,
+		"Sync":        EvacuateSync,
+	} {
+		t.Run(name, func(t *testing.T) {
+			m, err := NewCMapWithOptions[int, int](WithEvacuateMode(mode))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var wg sync.WaitGroup
+			for g := 0; g < 4; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := g; i < mapSize; i += 4 {
+						m.Store(i, i)
+					}
+					for i := g; i < mapSize; i += 4 {
+						if i%3 == 0 {
+							m.Delete(i)
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+			if err := m.WaitResize(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if n := m.getNode(); atomic.LoadUint32(&n.resize) != 0 || n.growing() {
+				t.Fatalf("WaitResize returned while resizing")
+			}
+			for i := 0; i < mapSize; i++ {
+				v, ok := m.Load(i)
+				if want := i%3 != 0; ok != want || (ok && v != i) {
+					t.Fatalf("Load(%v) = %v, %v, want %v, %v", i, v, ok, i, want)
+				}
+			}
+		})
+	}
+
+	// A synchronous write completes the resize it starts.
+	m, _ := NewCMapWithOptions[int, int](WithEvacuateMode(EvacuateSync))
+	for i := 0; i < mapSize; i++ {
+		m.Store(i, i)
+		if atomic.LoadUint32(&m.getNode().resize) != 0 {
+			t.Fatalf("Store(%v) returned during a synchronous resize", i)
+		}
+	}
+
+	// Nothing drives an incremental evacuation without writes, until
+	// WaitResize helps.
+	m, _ = NewCMapWithOptions[int, int](WithEvacuateMode(EvacuateIncremental))
+	for i := 0; i < mapSize; i++ {
+		m.Store(i, i)
+	}
+	m.Reserve(mapSize<<4, false)
+	if atomic.LoadUint32(&m.getNode().resize) == 0 {
+		t.Fatalf("incremental resize completed without writes")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.WaitResize(ctx); err != context.Canceled {
+		t.Fatalf("WaitResize with a canceled context = %v, want %v", err, context.Canceled)
+	}
+	if err := m.WaitResize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadUint32(&m.getNode().resize) != 0 {
+		t.Fatalf("WaitResize returned during an incremental resize")
+	}
+}
+
+func TestHashSeed(t *testing.T) {
+	const keys = 64
+
+	// Collect keys that all fall into bucket 0 of one map, as an attacker
+	// who learned its seed would.
+	var m1 CMap[string, int]
+	n1 := m1.getNode()
+	var flood []string
+	for i := 0; len(flood) < keys; i++ {
+		k := fmt.Sprint("X-Header-", i)
+		if chash(k, n1.seed)&n1.mask == 0 {
+			flood = append(flood, k)
+		}
+	}
+
+	spread := func(hash func(string) uintptr, mask uintptr) int {
+		seen := make(map[uintptr]bool)
+		for _, k := range flood {
+			seen[hash(k)&mask] = true
+		}
+		return len(seen)
+	}
+
+	var m2 CMap[string, int]
+	n2 := m2.getNode()
+	if n1.seed == n2.seed {
+		t.Fatalf("two CMaps share the hash seed %v", n1.seed)
+	}
+	if got := spread(m2.hash, n2.mask); got == 1 {
+		t.Errorf("%v colliding keys fall into a single bucket of a fresh CMap", keys)
+	}
+
+	var f FMap[string, int]
+	f.onceInit(0)
+	if got := spread(f.hash, f.mask); got == 1 {
+		t.Errorf("%v colliding keys fall into a single bucket of a fresh FMap", keys)
+	}
+
+	// The seed survives resizes and Clear, which rely on it being stable.
+	for _, k := range flood {
+		m1.Store(k, 0)
+	}
+	m1.Reserve(1<<12, true)
+	m1.Clear()
+	if seed := m1.getNode().seed; seed != n1.seed {
+		t.Errorf("seed changed from %v to %v", n1.seed, seed)
+	}
+}
+
+// BenchmarkHash compares chash with the chash it replaced, oldChash, which
+// hashed the key as an interface value with the runtime's nilinterhash.
+func BenchmarkHash(b *testing.B) {
+	benchHash(b, "int", func(i int) int { return i })
+	benchHash(b, "uint64", func(i int) uint64 { return uint64(i) })
+	benchHash(b, "string", func(i int) string { return fmt.Sprint("X-Header-", i) })
+	benchHash(b, "[8]byte", func(i int) [8]byte { return [8]byte{byte(i), byte(i >> 8)} })
+	benchHash(b, "[16]byte", func(i int) [16]byte { return [16]byte{byte(i), byte(i >> 8)} })
+	benchHash(b, "[32]byte", func(i int) [32]byte { return [32]byte{byte(i), byte(i >> 8)} })
+	benchHash(b, "time.Duration", func(i int) time.Duration { return time.Duration(i) })
+	benchHash(b, "struct{a,b int32}", func(i int) struct{ a, b int32 } { return struct{ a, b int32 }{int32(i), 1} })
+	benchHash(b, "struct{a,b int64}", func(i int) struct{ a, b int64 } { return struct{ a, b int64 }{int64(i), 1} })
+	benchHash(b, "float64", func(i int) float64 { return float64(i) })
+	benchHash(b, "any", func(i int) any { return i })
+}
+
+func benchHash[K comparable](b *testing.B, name string, key func(int) K) {
+	seed := newSeed[K]()
+	oldSeed := uintptr(seed.k0)
+	keys := make([]K, 1024)
+	for i := range keys {
+		keys[i] = key(i)
+	}
+	var sink uintptr
+	b.Run(name+"/chash", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			sink += chash(keys[i&1023], seed)
+		}
+	})
+	b.Run(name+"/old", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			sink += oldChash(keys[i&1023], oldSeed)
+		}
+	})
+	_ = sink
+}
+
+func TestMemHashable(t *testing.T) {
+	type padded struct {
+		a int8
+		b int64
+	}
+	type blank struct {
+		a int32
+		_ int32
+	}
+	for _, tt := range []struct {
+		typ  reflect.Type
+		want bool
+	}{
+		{reflect.TypeFor[int](), true},
+		{reflect.TypeFor[[16]byte](), true},
+		{reflect.TypeFor[struct{ a, b int32 }](), true},
+		{reflect.TypeFor[[2]struct{ a, b int32 }](), true},
+		{reflect.TypeFor[string](), false},
+		{reflect.TypeFor[float64](), false},
+		{reflect.TypeFor[*int](), false},
+		{reflect.TypeFor[any](), false},
+		{reflect.TypeFor[padded](), false},
+		{reflect.TypeFor[blank](), false},
+	} {
+		if got := memHashable(tt.typ); got != tt.want {
+			t.Errorf("memHashable(%v) = %v, want %v", tt.typ, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		typ  reflect.Type
+		want uint8
+	}{
+		{reflect.TypeFor[int8](), 1},
+		{reflect.TypeFor[time.Duration](), 8},
+		{reflect.TypeFor[[16]byte](), 8},
+		{reflect.TypeFor[struct{ a, b int64 }](), 8},
+		{reflect.TypeFor[struct{ a, b int32 }](), 4},
+		{reflect.TypeFor[struct{ a [2]int32 }](), 4},
+		{reflect.TypeFor[[3]byte](), 0},
+		{reflect.TypeFor[[32]byte](), 0},
+		{reflect.TypeFor[struct{ a, b int16 }](), 0},
+		{reflect.TypeFor[padded](), 0},
+	} {
+		if got := memWidth(tt.typ); got != tt.want {
+			t.Errorf("memWidth(%v) = %v, want %v", tt.typ, got, tt.want)
+		}
+	}
+
+	// Equal keys with different memory must hash the same.
+	if s := newSeed[float64](); chash(0.0, s) != chash(math.Copysign(0, -1), s) {
+		t.Errorf("0 and -0 hash differently")
+	}
+	s := newSeed[padded]()
+	p1, p2 := padded{a: 1, b: 2}, padded{a: 1, b: 2}
+	*(*byte)(unsafe.Add(unsafe.Pointer(&p2), 1)) = 0xff // padding
+	if chash(p1, s) != chash(p2, s) {
+		t.Errorf("padding changes the hash of %v", p1)
+	}
+}
+
+// BenchmarkCounter compares the striped counter with a single atomic word
+// under contention; run it with a high -cpu, like -cpu=8,32,96.
+func BenchmarkCounter(b *testing.B) {
+	b.Run("atomic", func(b *testing.B) {
+		var n int64
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				atomic.AddInt64(&n, 1)
+			}
+		})
+	})
+	b.Run("striped", func(b *testing.B) {
+		var c counter
+		var g uint64
+		b.RunParallel(func(pb *testing.PB) {
+			// Spread the goroutines over the cells as distinct keys would.
+			i := uintptr(atomic.AddUint64(&g, 1))
+			for pb.Next() {
+				c.add(i, 1)
+			}
+		})
+	})
+}
+
+func TestCounter(t *testing.T) {
+	const goroutines, adds = 8, 1 << 12
+
+	var c counter
+	if n := c.sum(); n != 0 {
+		t.Fatalf("sum of the zero counter = %v, want 0", n)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < adds; i++ {
+				c.add(uintptr(g*adds+i), 2)
+				c.addAny(-1)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if n := c.sum(); n != goroutines*adds {
+		t.Fatalf("sum() = %v, want %v", n, goroutines*adds)
+	}
+	c.sub(c.load())
+	if n := c.sum(); n != 0 {
+		t.Fatalf("sum() = %v after subtracting its cells, want 0", n)
+	}
+}
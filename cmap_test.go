@@ -5,6 +5,11 @@
 package cmap_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"iter"
 	"math/rand"
 	"reflect"
 	"runtime"
@@ -12,44 +17,61 @@ import (
 	"sync/atomic"
 	"testing"
 	"testing/quick"
+	"time"
 
 	"github.com/min1324/cmap"
+	"github.com/min1324/cmap/cmaptest"
 )
 
-type mapOp string
-
-const (
-	opLoad          = mapOp("Load")
-	opStore         = mapOp("Store")
-	opLoadOrStore   = mapOp("LoadOrStore")
-	opLoadAndDelete = mapOp("LoadAndDelete")
-	opDelete        = mapOp("Delete")
-)
-
-var mapOps = [...]mapOp{opLoad, opStore, opLoadOrStore, opLoadAndDelete, opDelete}
-
 // mapCall is a quick.Generator for calls on mapInterface.
 type mapCall struct {
-	op   mapOp
+	op   cmaptest.OpKind
 	k, v any
 }
 
+// mapOps are the kinds of calls the reference maps support.
+var mapOps = [...]cmaptest.OpKind{
+	cmaptest.OpLoad,
+	cmaptest.OpStore,
+	cmaptest.OpLoadOrStore,
+	cmaptest.OpLoadAndDelete,
+	cmaptest.OpDelete,
+	cmaptest.OpSwap,
+	cmaptest.OpCompareAndSwap,
+	cmaptest.OpCompareAndDelete,
+}
+
 func (c mapCall) apply(m mapInterface) (any, bool) {
 	switch c.op {
-	case opLoad:
+	case cmaptest.OpLoad:
 		return m.Load(c.k)
-	case opStore:
+	case cmaptest.OpStore:
 		m.Store(c.k, c.v)
 		return nil, false
-	case opLoadOrStore:
+	case cmaptest.OpLoadOrStore:
 		return m.LoadOrStore(c.k, c.v)
-	case opLoadAndDelete:
+	case cmaptest.OpLoadAndDelete:
 		return m.LoadAndDelete(c.k)
-	case opDelete:
+	case cmaptest.OpDelete:
 		m.Delete(c.k)
 		return nil, false
+	case cmaptest.OpSwap:
+		return m.Swap(c.k, c.v)
+	case cmaptest.OpCompareAndSwap:
+		if m.CompareAndSwap(c.k, c.v, rand.Int()) {
+			m.Delete(c.k)
+			return c.v, true
+		}
+		return nil, false
+	case cmaptest.OpCompareAndDelete:
+		if m.CompareAndDelete(c.k, c.v) {
+			if _, ok := m.Load(c.k); !ok {
+				return nil, true
+			}
+		}
+		return nil, false
 	default:
-		panic("invalid mapOp")
+		panic("invalid OpKind")
 	}
 }
 
@@ -69,7 +91,7 @@ func randValue(r *rand.Rand) any {
 func (mapCall) Generate(r *rand.Rand, size int) reflect.Value {
 	c := mapCall{op: mapOps[rand.Intn(len(mapOps))], k: randValue(r)}
 	switch c.op {
-	case opStore, opLoadOrStore:
+	case cmaptest.OpStore, cmaptest.OpLoadOrStore, cmaptest.OpSwap, cmaptest.OpCompareAndSwap, cmaptest.OpCompareAndDelete:
 		c.v = randValue(r)
 	}
 	return reflect.ValueOf(c)
@@ -91,15 +113,15 @@ func applyCalls(m mapInterface, calls []mapCall) (results []mapResult, final map
 }
 
 func applyCMap(calls []mapCall) ([]mapResult, map[any]any) {
-	return applyCalls(new(cmap.CMap), calls)
+	return applyCalls(new(cmap.CMap[any, any]), calls)
 }
 
 func applyFMap(calls []mapCall) ([]mapResult, map[any]any) {
-	return applyCalls(new(cmap.FMap), calls)
+	return applyCalls(new(cmap.FMap[any, any]), calls)
 }
 
 func applySyncMap(calls []mapCall) ([]mapResult, map[any]any) {
-	return applyCalls(new(cmap.Map), calls)
+	return applyCalls(new(cmap.Map[any, any]), calls)
 }
 
 func applyRWMutexMap(calls []mapCall) ([]mapResult, map[any]any) {
@@ -111,7 +133,7 @@ func applyDeepCopyMap(calls []mapCall) ([]mapResult, map[any]any) {
 }
 
 func TestMapEvacute(t *testing.T) {
-	var m cmap.CMap
+	var m cmap.CMap[int, int]
 	for i := 0; i < 1<<20; i++ {
 		m.Store(i, i)
 	}
@@ -151,7 +173,7 @@ func TestMapMatchesDeepCopy(t *testing.T) {
 func TestConcurrentRange(t *testing.T) {
 	const mapSize = 1 << 10
 
-	m := new(cmap.CMap)
+	m := new(cmap.CMap[int64, int64])
 	for n := int64(1); n <= mapSize; n++ {
 		m.Store(n, int64(n))
 	}
@@ -191,8 +213,7 @@ func TestConcurrentRange(t *testing.T) {
 	for n := iters; n > 0; n-- {
 		seen := make(map[int64]bool, mapSize)
 
-		m.Range(func(ki, vi any) bool {
-			k, v := ki.(int64), vi.(int64)
+		m.Range(func(k, v int64) bool {
 			if v%k != 0 {
 				t.Fatalf("while Storing multiples of %v, Range saw value %v", k, v)
 			}
@@ -210,7 +231,7 @@ func TestConcurrentRange(t *testing.T) {
 }
 
 func TestIssue40999(t *testing.T) {
-	var m cmap.CMap
+	var m cmap.CMap[any, any]
 
 	// Since the miss-counting in missLocked (via Delete)
 	// compares the miss count with len(m.dirty),
@@ -236,7 +257,7 @@ func TestMapStoreAndLoad(t *testing.T) {
 	const mapSize = 1 << 14
 
 	var (
-		m    cmap.CMap
+		m    cmap.CMap[int64, int64]
 		wg   sync.WaitGroup
 		seen = make(map[int64]bool, mapSize)
 	)
@@ -252,8 +273,7 @@ func TestMapStoreAndLoad(t *testing.T) {
 
 	wg.Wait()
 
-	m.Range(func(ki, vi any) bool {
-		k, v := ki.(int64), vi.(int64)
+	m.Range(func(k, v int64) bool {
 		if v%k != 0 {
 			t.Fatalf("while Storing multiples of %v, Range saw value %v", k, v)
 		}
@@ -279,7 +299,7 @@ func TestMapStoreAndLoad(t *testing.T) {
 
 	wg.Wait()
 
-	m.Range(func(key, value any) bool {
+	m.Range(func(key, value int64) bool {
 		t.Fatalf("Map should be empty")
 		return false
 	})
@@ -289,23 +309,23 @@ func TestCount(t *testing.T) {
 	const want = 1025
 	tests := []struct {
 		name string
-		m    cmap.Interface
+		m    cmap.Interface[any, any]
 		want int
 	}{
 		// TODO: Add test cases.
 		{
 			"fmap",
-			&cmap.FMap{},
+			&cmap.FMap[any, any]{},
 			want,
 		},
 		{
 			"cmap",
-			&cmap.CMap{},
+			&cmap.CMap[any, any]{},
 			want,
 		},
 		{
 			"map",
-			&cmap.Map{},
+			&cmap.Map[any, any]{},
 			want,
 		},
 	}
@@ -318,6 +338,1173 @@ func TestCount(t *testing.T) {
 			if got := tt.m.Count(); int(got) != tt.want {
 				t.Errorf("Count() = %v, want %v", got, tt.want)
 			}
+			if got := tt.m.Len(); got != tt.want {
+				t.Errorf("Len() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCountAfterQuiescence runs random operations on all three maps from
+// several goroutines, with Len called concurrently, and checks that once
+// they have returned Count and Len agree with a full Range.
+func TestCountAfterQuiescence(t *testing.T) {
+	const (
+		goroutines = 8
+		keys       = 1 << 8
+	)
+	ops := 1 << 13
+	if testing.Short() {
+		ops = 1 << 10
+	}
+
+	for _, tt := range []struct {
+		name string
+		m    cmap.Interface[int, int]
+	}{
+		{"map", cmap.New[int, int]()},
+		{"cmap", cmap.NewCMap[int, int]()},
+		{"fmap", cmap.NewFMap[int, int](0)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.m
+			done := make(chan struct{})
+			lens := make(chan error)
+			go func() {
+				var err error
+				defer func() { lens <- err }()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					if l := m.Len(); l < 0 || l > keys {
+						err = fmt.Errorf("Len() = %v, want within [0, %v]", l, keys)
+					}
+				}
+			}()
+
+			var wg sync.WaitGroup
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					r := rand.New(rand.NewSource(int64(g)))
+					for i := 0; i < ops; i++ {
+						k, v := r.Intn(keys), r.Intn(4)
+						switch r.Intn(10) {
+						case 0:
+							m.Store(k, v)
+						case 1:
+							m.LoadOrStore(k, v)
+						case 2:
+							m.LoadOrCompute(k, func() int { return v })
+						case 3:
+							m.Swap(k, v)
+						case 4:
+							m.CompareAndSwap(k, v, r.Intn(4))
+						case 5:
+							m.Delete(k)
+						case 6:
+							m.LoadAndDelete(k)
+						case 7:
+							m.CompareAndDelete(k, v)
+						case 8:
+							if r.Intn(ops/8) == 0 {
+								m.Clear()
+							}
+						case 9:
+							m.Load(k)
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+			close(done)
+			if err := <-lens; err != nil {
+				t.Fatal(err)
+			}
+
+			n := 0
+			m.Range(func(int, int) bool {
+				n++
+				return true
+			})
+			if c := m.Count(); c != int64(n) {
+				t.Errorf("Count() = %v, Range visited %v keys", c, n)
+			}
+			if l := m.Len(); l != n {
+				t.Errorf("Len() = %v, Range visited %v keys", l, n)
+			}
+		})
+	}
+}
+
+func TestCMapTyped(t *testing.T) {
+	type point struct{ x, y int }
+
+	var m cmap.CMap[string, point]
+	m.Store("a", point{1, 2})
+	if v, ok := m.Load("a"); !ok || v != (point{1, 2}) {
+		t.Fatalf("Load(a) = %v, %v, want %v, true", v, ok, point{1, 2})
+	}
+	if v, ok := m.Load("b"); ok || v != (point{}) {
+		t.Fatalf("Load(b) = %v, %v, want zero value, false", v, ok)
+	}
+	if v, loaded := m.LoadOrStore("a", point{3, 4}); !loaded || v != (point{1, 2}) {
+		t.Fatalf("LoadOrStore(a) = %v, %v, want %v, true", v, loaded, point{1, 2})
+	}
+	if v, loaded := m.LoadAndDelete("a"); !loaded || v != (point{1, 2}) {
+		t.Fatalf("LoadAndDelete(a) = %v, %v, want %v, true", v, loaded, point{1, 2})
+	}
+
+	var n cmap.CMap[int, int]
+	for i := 0; i < 1<<10; i++ {
+		n.Store(i, i)
+	}
+	allocs := testing.AllocsPerRun(10, func() {
+		n.Load(1 << 9)
+		n.Store(1<<9, 1<<9)
+	})
+	if allocs != 0 {
+		t.Errorf("Load/Store of int key allocated %v times, want 0", allocs)
+	}
+}
+
+func TestFMapShards(t *testing.T) {
+	const mapSize = 1 << 10
+
+	for _, shards := range []int{0, 1, 3, 64, 100} {
+		m := cmap.NewFMap[int, int](shards)
+		for i := 0; i < mapSize; i++ {
+			m.Store(i, i)
+		}
+		seen := make(map[int]bool, mapSize)
+		m.Range(func(k, v int) bool {
+			if k != v {
+				t.Fatalf("shards %d: Range saw %v: %v", shards, k, v)
+			}
+			if seen[k] {
+				t.Fatalf("shards %d: Range visited key %v twice", shards, k)
+			}
+			seen[k] = true
+			return true
+		})
+		if len(seen) != mapSize || m.Count() != mapSize {
+			t.Fatalf("shards %d: Range visited %v, Count %v, want %v", shards, len(seen), m.Count(), mapSize)
+		}
+	}
+}
+
+func TestMapSwapAndCompare(t *testing.T) {
+	var m cmap.Map[string, int]
+
+	if prev, loaded := m.Swap("a", 1); loaded || prev != 0 {
+		t.Fatalf("Swap(a, 1) = %v, %v, want 0, false", prev, loaded)
+	}
+	if prev, loaded := m.Swap("a", 2); !loaded || prev != 1 {
+		t.Fatalf("Swap(a, 2) = %v, %v, want 1, true", prev, loaded)
+	}
+	if m.CompareAndSwap("a", 1, 3) {
+		t.Fatalf("CompareAndSwap(a, 1, 3) swapped a value of 2")
+	}
+	if !m.CompareAndSwap("a", 2, 3) {
+		t.Fatalf("CompareAndSwap(a, 2, 3) did not swap")
+	}
+	if m.CompareAndSwap("b", 0, 1) {
+		t.Fatalf("CompareAndSwap(b, 0, 1) swapped a missing key")
+	}
+	if m.CompareAndDelete("a", 2) {
+		t.Fatalf("CompareAndDelete(a, 2) deleted a value of 3")
+	}
+	if !m.CompareAndDelete("a", 3) {
+		t.Fatalf("CompareAndDelete(a, 3) did not delete")
+	}
+	if _, ok := m.Load("a"); ok {
+		t.Fatalf("Load(a) found a deleted key")
+	}
+	if got := m.Count(); got != 0 {
+		t.Fatalf("Count() = %v, want 0", got)
+	}
+
+	for i := 0; i < 100; i++ {
+		m.Store(fmt.Sprint(i), i)
+	}
+	// Promote the dirty map so the following operations hit the read map.
+	m.Range(func(string, int) bool { return true })
+	for i := 0; i < 50; i++ {
+		m.Delete(fmt.Sprint(i))
+	}
+	for i := 0; i < 25; i++ {
+		m.Store(fmt.Sprint(i), i)
+	}
+	if got := m.Count(); got != 75 {
+		t.Fatalf("Count() = %v, want 75", got)
+	}
+
+	m.Clear()
+	if got := m.Count(); got != 0 {
+		t.Fatalf("Count() after Clear = %v, want 0", got)
+	}
+	m.Range(func(k string, v int) bool {
+		t.Fatalf("Range after Clear visited %v: %v", k, v)
+		return false
+	})
+	m.Store("a", 1)
+	if v, ok := m.Load("a"); !ok || v != 1 || m.Count() != 1 {
+		t.Fatalf("Load(a) after Clear = %v, %v, Count %v, want 1, true, 1", v, ok, m.Count())
+	}
+}
+
+func TestMapConcurrentClear(t *testing.T) {
+	const mapSize = 1 << 10
+
+	var (
+		m  cmap.Map[int, int]
+		wg sync.WaitGroup
+	)
+	for g := 0; g < runtime.GOMAXPROCS(0); g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < mapSize*4; i++ {
+				k := r.Intn(mapSize)
+				switch r.Intn(4) {
+				case 0:
+					m.Swap(k, i)
+				case 1:
+					m.CompareAndDelete(k, k)
+				case 2:
+					m.LoadOrStore(k, k)
+				case 3:
+					m.LoadAndDelete(k)
+				}
+				if i%mapSize == 0 {
+					m.Clear()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	var n int64
+	m.Range(func(int, int) bool {
+		n++
+		return true
+	})
+	if got := m.Count(); got != n {
+		t.Fatalf("Count() = %v, Range visited %v", got, n)
+	}
+}
+
+func TestCMapCompareAndSwapResize(t *testing.T) {
+	const keys, grow = 1 << 6, 1 << 14
+
+	var (
+		m  cmap.CMap[int, int]
+		wg sync.WaitGroup
+	)
+	procs := runtime.GOMAXPROCS(0)
+	for g := 0; g < procs; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for k := 0; k < keys; k++ {
+				for {
+					v, loaded := m.LoadOrStore(k, 1)
+					if !loaded || m.CompareAndSwap(k, v, v+1) {
+						break
+					}
+				}
+			}
+			// Grow and then shrink the map while other goroutines swap.
+			for i := 0; i < grow; i++ {
+				m.Store(keys+g*grow+i, i)
+			}
+			for i := 0; i < grow; i++ {
+				if !m.CompareAndDelete(keys+g*grow+i, i) {
+					t.Errorf("CompareAndDelete(%v, %v) did not delete", keys+g*grow+i, i)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for k := 0; k < keys; k++ {
+		if v, _ := m.Load(k); v != procs {
+			t.Errorf("Load(%v) = %v, want %v", k, v, procs)
+		}
+	}
+	if got := m.Count(); got != keys {
+		t.Errorf("Count() = %v, want %v", got, keys)
+	}
+}
+
+func TestCMapCompute(t *testing.T) {
+	const mapSize = 1 << 12
+
+	var (
+		m  cmap.CMap[int, int]
+		wg sync.WaitGroup
+	)
+	incr := func(old int, loaded bool) (int, cmap.ComputeOp) {
+		return old + 1, cmap.ComputeUpdate
+	}
+	procs := runtime.GOMAXPROCS(0)
+	for g := 0; g < procs; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; k < mapSize; k++ {
+				m.Compute(k, incr)
+			}
+		}()
+	}
+	wg.Wait()
+	for k := 0; k < mapSize; k++ {
+		if v, _ := m.Load(k); v != procs {
+			t.Fatalf("Load(%v) = %v, want %v", k, v, procs)
+		}
+	}
+
+	v, ok := m.Compute(0, func(old int, loaded bool) (int, cmap.ComputeOp) {
+		return -1, cmap.ComputeKeep
+	})
+	if !ok || v != procs {
+		t.Fatalf("Compute keep = %v, %v, want %v, true", v, ok, procs)
+	}
+	if v, ok := m.Compute(-1, func(old int, loaded bool) (int, cmap.ComputeOp) {
+		return -1, cmap.ComputeKeep
+	}); ok || v != 0 {
+		t.Fatalf("Compute keep on missing key = %v, %v, want 0, false", v, ok)
+	}
+	for k := 0; k < mapSize; k++ {
+		if v, ok := m.Compute(k, func(old int, loaded bool) (int, cmap.ComputeOp) {
+			if !loaded {
+				t.Fatalf("Compute(%v) found no value", k)
+			}
+			return 0, cmap.ComputeDelete
+		}); ok || v != 0 {
+			t.Fatalf("Compute delete = %v, %v, want 0, false", v, ok)
+		}
+	}
+	if got := m.Count(); got != 0 {
+		t.Fatalf("Count() = %v, want 0", got)
+	}
+}
+
+func TestLoadOrCompute(t *testing.T) {
+	const mapSize = 1 << 10
+
+	for _, m := range [...]cmap.Interface[int, int]{
+		&cmap.Map[int, int]{},
+		&cmap.FMap[int, int]{},
+		&cmap.CMap[int, int]{},
+	} {
+		t.Run(fmt.Sprintf("%T", m), func(t *testing.T) {
+			var (
+				wg    sync.WaitGroup
+				calls [mapSize]int32
+			)
+			for g := 0; g < runtime.GOMAXPROCS(0); g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for k := 0; k < mapSize; k++ {
+						k := k
+						v, _ := m.LoadOrCompute(k, func() int {
+							if atomic.AddInt32(&calls[k], 1) != 1 {
+								t.Errorf("valueFn for %v called more than once", k)
+							}
+							return k * 2
+						})
+						if v != k*2 {
+							t.Errorf("LoadOrCompute(%v) = %v, want %v", k, v, k*2)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			if got := m.Count(); got != mapSize {
+				t.Errorf("Count() = %v, want %v", got, mapSize)
+			}
+			v, loaded := m.LoadOrCompute(0, func() int {
+				t.Fatalf("valueFn called for a present key")
+				return 0
+			})
+			if !loaded || v != 0 {
+				t.Errorf("LoadOrCompute(0) = %v, %v, want 0, true", v, loaded)
+			}
+		})
+	}
+}
+
+func TestClear(t *testing.T) {
+	const mapSize = 1 << 12
+
+	for _, m := range [...]cmap.Interface[int, int]{
+		&cmap.Map[int, int]{},
+		&cmap.FMap[int, int]{},
+		&cmap.CMap[int, int]{},
+	} {
+		t.Run(fmt.Sprintf("%T", m), func(t *testing.T) {
+			for i := 0; i < mapSize; i++ {
+				m.Store(i, i)
+			}
+			m.Clear()
+			if got := m.Count(); got != 0 {
+				t.Fatalf("Count() after Clear = %v, want 0", got)
+			}
+			m.Range(func(k, v int) bool {
+				t.Fatalf("Range after Clear visited %v: %v", k, v)
+				return false
+			})
+
+			// Clear while other goroutines store, delete and resize the map.
+			var wg sync.WaitGroup
+			for g := 0; g < runtime.GOMAXPROCS(0); g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					r := rand.New(rand.NewSource(int64(g)))
+					for i := 0; i < mapSize; i++ {
+						k := r.Intn(mapSize)
+						if r.Intn(3) == 0 {
+							m.Delete(k)
+						} else {
+							m.Store(k, k)
+						}
+						if i%(mapSize/4) == 0 {
+							m.Clear()
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+
+			var n int64
+			m.Range(func(k, v int) bool {
+				n++
+				return true
+			})
+			if got := m.Count(); got != n {
+				t.Fatalf("Count() = %v, Range visited %v", got, n)
+			}
+		})
+	}
+}
+
+type iterMap interface {
+	cmap.Interface[int, int]
+	All() iter.Seq2[int, int]
+	Keys() iter.Seq[int]
+	Values() iter.Seq[int]
+}
+
+func TestIterators(t *testing.T) {
+	const mapSize = 1 << 10
+
+	for _, m := range [...]iterMap{
+		&cmap.Map[int, int]{},
+		&cmap.FMap[int, int]{},
+		&cmap.CMap[int, int]{},
+	} {
+		t.Run(fmt.Sprintf("%T", m), func(t *testing.T) {
+			for i := 0; i < mapSize; i++ {
+				m.Store(i, -i)
+			}
+
+			seen := make(map[int]bool, mapSize)
+			for k, v := range m.All() {
+				if v != -k {
+					t.Fatalf("All yielded %v: %v, want %v: %v", k, v, k, -k)
+				}
+				if seen[k] {
+					t.Fatalf("All yielded key %v twice", k)
+				}
+				seen[k] = true
+			}
+			if len(seen) != mapSize {
+				t.Fatalf("All yielded %v keys, want %v", len(seen), mapSize)
+			}
+
+			var keys, values int
+			for k := range m.Keys() {
+				keys += k
+			}
+			for v := range m.Values() {
+				values -= v
+			}
+			if want := mapSize * (mapSize - 1) / 2; keys != want || values != want {
+				t.Fatalf("sum of Keys = %v, of Values = %v, want %v", keys, values, want)
+			}
+
+			n := 0
+			for range m.All() {
+				if n++; n == 10 {
+					break
+				}
+			}
+			if n != 10 {
+				t.Fatalf("All yielded %v keys before break, want 10", n)
+			}
+		})
+	}
+}
+
+func TestCMapRangeAllocs(t *testing.T) {
+	const mapSize = 1 << 12
+
+	if raceEnabled {
+		t.Skip("sync.Pool drops items at random under the race detector")
+	}
+
+	var m cmap.CMap[int, int]
+	for i := 0; i < mapSize; i++ {
+		m.Store(i, i)
+	}
+	m.WaitResize(context.Background())
+
+	// AllocsPerRun counts every allocation of the process, so the background
+	// evacuation of a map left by an earlier test, or a GC emptying the pool
+	// of buffers, may show up in a single measurement.
+	var n int
+	var allocs float64
+	for try := 0; try < 3; try++ {
+		allocs = testing.AllocsPerRun(10, func() {
+			n = 0
+			m.Range(func(k, v int) bool {
+				n++
+				return true
+			})
+		})
+		if allocs == 0 {
+			break
+		}
+	}
+	if n != mapSize {
+		t.Fatalf("Range visited %v keys, want %v", n, mapSize)
+	}
+	if allocs != 0 {
+		t.Errorf("Range allocated %v times, want 0", allocs)
+	}
+}
+
+func TestCMapParallelRange(t *testing.T) {
+	const mapSize = 1 << 14
+
+	var m cmap.CMap[int, int]
+	for i := 0; i < mapSize; i++ {
+		m.Store(i, i)
+	}
+
+	// Grow the map with other keys while ranging, so that the node is
+	// replaced midway.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := mapSize; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			m.Store(i, i)
+		}
+	}()
+
+	for _, workers := range []int{0, 1, 3, 1 << 10} {
+		var seen [mapSize]int32
+		m.ParallelRange(workers, func(k, v int) bool {
+			if k != v {
+				t.Errorf("ParallelRange saw %v: %v", k, v)
+			}
+			if k < mapSize && atomic.AddInt32(&seen[k], 1) != 1 {
+				t.Errorf("ParallelRange visited key %v twice", k)
+			}
+			return true
+		})
+		for k := range seen {
+			if seen[k] != 1 {
+				t.Fatalf("workers %d: ParallelRange did not visit key %v", workers, k)
+			}
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	var calls int32
+	m.ParallelRange(4, func(k, v int) bool {
+		atomic.AddInt32(&calls, 1)
+		return false
+	})
+	if calls < 1 || calls > 4 {
+		t.Fatalf("ParallelRange called f %v times after it returned false, want 1 to 4", calls)
+	}
+}
+
+func TestCMapScan(t *testing.T) {
+	const mapSize = 1 << 10
+
+	var m cmap.CMap[int, int]
+	for i := 0; i < mapSize; i++ {
+		m.Store(i, i)
+	}
+
+	seen := make(map[int]bool, mapSize)
+	var cursor uint64
+	for calls := 0; ; calls++ {
+		var entries []cmap.Entry[int, int]
+		entries, cursor = m.Scan(cursor, 16)
+		for _, e := range entries {
+			if e.Key != e.Value {
+				t.Fatalf("Scan returned %v: %v", e.Key, e.Value)
+			}
+			seen[e.Key] = true
+		}
+		if cursor == 0 {
+			break
+		}
+		// Grow the map with other keys, then shrink it back, between calls.
+		switch calls % 8 {
+		case 2:
+			for i := 0; i < mapSize*16; i++ {
+				m.Store(mapSize+i, mapSize+i)
+			}
+		case 6:
+			for i := 0; i < mapSize*16; i++ {
+				m.Delete(mapSize + i)
+			}
+		}
+	}
+	for k := 0; k < mapSize; k++ {
+		if !seen[k] {
+			t.Fatalf("Scan did not return key %v", k)
+		}
+	}
+
+	var empty cmap.CMap[int, int]
+	if entries, next := empty.Scan(0, 0); len(entries) != 0 || next != 0 {
+		t.Fatalf("Scan of an empty map = %v, %v, want no entries and cursor 0", entries, next)
+	}
+}
+
+func TestCMapSnapshot(t *testing.T) {
+	const mapSize = 1 << 8
+
+	var m cmap.CMap[int, int]
+	for k := 0; k < mapSize; k++ {
+		m.Store(k, 0)
+	}
+
+	// The writer increments the keys in order, so at any single point in
+	// time the values never increase with the key and differ by at most one.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		incr := func(old int, _ bool) (int, cmap.ComputeOp) {
+			return old + 1, cmap.ComputeUpdate
+		}
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for k := 0; k < mapSize; k++ {
+				m.Compute(k, incr)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := mapSize; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// Grow and shrink the map with other keys.
+			m.Store(-i, i)
+			if i%(mapSize*8) == 0 {
+				for j := mapSize; j <= i; j++ {
+					m.Delete(-j)
+				}
+			}
+		}
+	}()
+
+	iters := 1 << 8
+	if testing.Short() {
+		iters = 16
+	}
+	for i := 0; i < iters; i++ {
+		s := m.Snapshot()
+		first, _ := s.Load(0)
+		prev := first
+		for k := 1; k < mapSize; k++ {
+			v, ok := s.Load(k)
+			if !ok {
+				t.Fatalf("Snapshot is missing key %v", k)
+			}
+			if v > prev || first-v > 1 {
+				t.Fatalf("Snapshot is inconsistent: key 0 = %v, key %v = %v, key %v = %v", first, k-1, prev, k, v)
+			}
+			prev = v
+		}
+		n := 0
+		for range s.All() {
+			n++
+		}
+		if n != s.Len() {
+			t.Fatalf("Snapshot All yielded %v entries, Len = %v", n, s.Len())
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+type resizeRecorder struct {
+	mu       sync.Mutex
+	started  []cmap.ResizeEvent
+	finished []cmap.ResizeEvent
+}
+
+func (r *resizeRecorder) ResizeStarted(e cmap.ResizeEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.started) != len(r.finished) {
+		panic("ResizeStarted before the previous resize finished")
+	}
+	r.started = append(r.started, e)
+}
+
+func (r *resizeRecorder) ResizeFinished(e cmap.ResizeEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finished = append(r.finished, e)
+}
+
+func TestCMapResizeObserver(t *testing.T) {
+	const mapSize = 1 << 12
+
+	r := &resizeRecorder{}
+	m, err := cmap.NewCMapWithOptions[int, int](cmap.WithResizeObserver(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < mapSize; i += 4 {
+				m.Store(i, i)
+			}
+		}(g)
+	}
+	wg.Wait()
+	m.WaitResize(context.Background())
+	for i := 0; i < mapSize; i++ {
+		m.Delete(i)
+		m.WaitResize(context.Background())
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.started) != len(r.finished) {
+		t.Fatalf("%v resizes started, %v finished", len(r.started), len(r.finished))
+	}
+	var want cmap.ResizeStats
+	for i, e := range r.finished {
+		s := r.started[i]
+		if s.OldB != e.OldB || s.NewB != e.NewB || s.Direction != e.Direction {
+			t.Errorf("resize %v started as %+v, finished as %+v", i, s, e)
+		}
+		if (e.Direction == cmap.ResizeGrow) != (e.NewB > e.OldB) {
+			t.Errorf("resize %v from B %v to %v is a %v", i, e.OldB, e.NewB, e.Direction)
+		}
+		if e.Direction == cmap.ResizeGrow {
+			want.Grows++
+		} else {
+			want.Shrinks++
+		}
+		want.KeysMoved += uint64(e.Keys)
+		want.Duration += e.Duration
+	}
+	if want.Grows == 0 || want.Shrinks == 0 {
+		t.Errorf("observed %v grows and %v shrinks, want some of both", want.Grows, want.Shrinks)
+	}
+	if got := m.ResizeStats(); got != want {
+		t.Errorf("ResizeStats() = %+v, want %+v", got, want)
+	}
+}
+
+// reentrantObserver reads and writes the map it observes from both events.
+type reentrantObserver struct {
+	m     *cmap.CMap[int, int]
+	calls atomic.Int64
+}
+
+func (o *reentrantObserver) ResizeStarted(e cmap.ResizeEvent) {
+	o.use(e)
+}
+
+func (o *reentrantObserver) ResizeFinished(e cmap.ResizeEvent) {
+	o.use(e)
+}
+
+func (o *reentrantObserver) use(e cmap.ResizeEvent) {
+	o.calls.Add(1)
+	for i := 0; i < 64; i++ {
+		o.m.Load(i)
+	}
+	o.m.Store(-1, int(e.NewB))
+	o.m.Len()
+}
+
+// TestCMapResizeObserverReentrant checks that an observer may use the map,
+// while a writer resizes it and Len and Snapshot lock all of its buckets.
+func TestCMapResizeObserverReentrant(t *testing.T) {
+	const mapSize = 1 << 12
+
+	o := &reentrantObserver{}
+	m, err := cmap.NewCMapWithOptions[int, int](cmap.WithResizeObserver(o))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.m = m
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stop := make(chan struct{})
+		locked := make(chan struct{})
+		go func() {
+			defer close(locked)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				m.Len()
+				m.Snapshot()
+			}
+		}()
+		for i := 0; i < mapSize; i++ {
+			m.Store(i, i)
+		}
+		for i := 0; i < mapSize; i++ {
+			m.Delete(i)
+		}
+		close(stop)
+		<-locked
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatal("deadlock: observer using the map blocked the resize")
+	}
+	if o.calls.Load() == 0 {
+		t.Error("observer never called")
+	}
+}
+
+// session is a key whose identity is only its tenant and id.
+type session struct {
+	tenant, id int
+	agent      string
+}
+
+type sessionHasher struct{}
+
+func (sessionHasher) Hash(seed maphash.Seed, k session) uint64 {
+	return maphash.Comparable(seed, [2]int{k.tenant, k.id})
+}
+
+func (sessionHasher) Equal(a, b session) bool {
+	return a.tenant == b.tenant && a.id == b.id
+}
+
+func TestHasher(t *testing.T) {
+	const mapSize = 1 << 12
+
+	cm, err := cmap.NewCMapWithOptions[session, int](cmap.WithHasher[session](sessionHasher{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []cmap.Interface[session, int]{
+		cm,
+		cmap.NewFMapWithHasher[session, int](0, sessionHasher{}),
+	} {
+		t.Run(fmt.Sprintf("%T", m), func(t *testing.T) {
+			for i := 0; i < mapSize; i++ {
+				m.Store(session{i % 7, i, "a"}, i)
+				if _, loaded := m.LoadOrStore(session{i % 7, i, "b"}, -1); !loaded {
+					t.Fatalf("LoadOrStore stored a key equal under the hasher")
+				}
+			}
+			if n := m.Count(); n != mapSize {
+				t.Fatalf("Count() = %v, want %v", n, mapSize)
+			}
+			for i := 0; i < mapSize; i++ {
+				k := session{i % 7, i, "c"}
+				if v, ok := m.Load(k); !ok || v != i {
+					t.Fatalf("Load(%v) = %v, %v, want %v, true", k, v, ok, i)
+				}
+				if !m.CompareAndSwap(k, i, -i) {
+					t.Fatalf("CompareAndSwap(%v, %v, %v) = false", k, i, -i)
+				}
+			}
+			m.Range(func(k session, v int) bool {
+				if k.agent != "a" || v != -k.id {
+					t.Fatalf("Range saw %v: %v, want the first stored key", k, v)
+				}
+				return true
+			})
+			for i := 0; i < mapSize; i++ {
+				if i%2 == 0 {
+					m.Delete(session{i % 7, i, "d"})
+				} else if !m.CompareAndDelete(session{i % 7, i, "d"}, -i) {
+					t.Fatalf("CompareAndDelete(%v) = false", i)
+				}
+			}
+			if n := m.Count(); n != 0 {
+				t.Fatalf("Count() = %v after deleting every key, want 0", n)
+			}
+		})
+	}
+
+	cm.Store(session{1, 1, "a"}, 1)
+	if v, ok := cm.Snapshot().Load(session{1, 1, "b"}); !ok || v != 1 {
+		t.Errorf("Snapshot().Load = %v, %v, want 1, true", v, ok)
+	}
+	if _, err := cmap.NewCMapWithOptions[int, int](cmap.WithHasher[session](sessionHasher{})); err == nil {
+		t.Errorf("NewCMapWithOptions accepted a hasher of another key type")
+	}
+}
+
+func TestCMapUnhashableKey(t *testing.T) {
+	type withSlice struct {
+		name string
+		v    any
+	}
+	var m cmap.CMap[any, int]
+	for _, tt := range []struct {
+		key       any
+		hashable  bool
+		keyString string
+	}{
+		{nil, true, ""},
+		{1, true, ""},
+		{"a", true, ""},
+		{[2]any{1, "a"}, true, ""},
+		{withSlice{"a", 1}, true, ""},
+		{[]int{1}, false, "[]int"},
+		{map[string]int{}, false, "map[string]int"},
+		{func() {}, false, "func()"},
+		{withSlice{"a", []byte("a")}, false, "cmap_test.withSlice"},
+		{[2]any{1, map[int]int{}}, false, "[2]interface {}"},
+	} {
+		err := m.TryStore(tt.key, 1)
+		if tt.hashable {
+			if err != nil {
+				t.Errorf("TryStore(%#v) = %v, want nil", tt.key, err)
+			} else if v, ok, err := m.TryLoad(tt.key); err != nil || !ok || v != 1 {
+				t.Errorf("TryLoad(%#v) = %v, %v, %v, want 1, true, nil", tt.key, v, ok, err)
+			}
+			continue
+		}
+		var e *cmap.UnhashableKeyError
+		if !errors.As(err, &e) || !errors.Is(err, cmap.ErrUnhashableKey) {
+			t.Errorf("TryStore(%T) = %v, want an UnhashableKeyError", tt.key, err)
+			continue
+		}
+		if e.Type.String() != tt.keyString {
+			t.Errorf("TryStore(%T) error type = %v, want %v", tt.key, e.Type, tt.keyString)
+		}
+		if _, _, err := m.TryLoad(tt.key); !errors.Is(err, cmap.ErrUnhashableKey) {
+			t.Errorf("TryLoad(%T) = %v, want ErrUnhashableKey", tt.key, err)
+		}
+		if _, _, err := m.TryLoadOrStore(tt.key, 1); !errors.Is(err, cmap.ErrUnhashableKey) {
+			t.Errorf("TryLoadOrStore(%T) = %v, want ErrUnhashableKey", tt.key, err)
+		}
+		if _, _, err := m.TrySwap(tt.key, 1); !errors.Is(err, cmap.ErrUnhashableKey) {
+			t.Errorf("TrySwap(%T) = %v, want ErrUnhashableKey", tt.key, err)
+		}
+		if _, _, err := m.TryLoadAndDelete(tt.key); !errors.Is(err, cmap.ErrUnhashableKey) {
+			t.Errorf("TryLoadAndDelete(%T) = %v, want ErrUnhashableKey", tt.key, err)
+		}
+		if err := m.TryDelete(tt.key); !errors.Is(err, cmap.ErrUnhashableKey) {
+			t.Errorf("TryDelete(%T) = %v, want ErrUnhashableKey", tt.key, err)
+		}
+		if _, err := m.TryCompareAndSwap(tt.key, 1, 2); !errors.Is(err, cmap.ErrUnhashableKey) {
+			t.Errorf("TryCompareAndSwap(%T) = %v, want ErrUnhashableKey", tt.key, err)
+		}
+		if _, err := m.TryCompareAndDelete(tt.key, 1); !errors.Is(err, cmap.ErrUnhashableKey) {
+			t.Errorf("TryCompareAndDelete(%T) = %v, want ErrUnhashableKey", tt.key, err)
+		}
+		if _, _, err := m.TryLoadOrCompute(tt.key, func() int {
+			t.Errorf("TryLoadOrCompute(%T) called valueFn", tt.key)
+			return 1
+		}); !errors.Is(err, cmap.ErrUnhashableKey) {
+			t.Errorf("TryLoadOrCompute(%T) = %v, want ErrUnhashableKey", tt.key, err)
+		}
+		if _, _, err := m.TryCompute(tt.key, func(int, bool) (int, cmap.ComputeOp) {
+			t.Errorf("TryCompute(%T) called f", tt.key)
+			return 1, cmap.ComputeUpdate
+		}); !errors.Is(err, cmap.ErrUnhashableKey) {
+			t.Errorf("TryCompute(%T) = %v, want ErrUnhashableKey", tt.key, err)
+		}
+	}
+	if n := m.Count(); n != 5 {
+		t.Errorf("Count() = %v, want 5", n)
+	}
+
+	// The checked compare and compute methods behave as the unchecked ones
+	// for a hashable key.
+	if ok, err := m.TryCompareAndSwap("a", 1, 2); err != nil || !ok {
+		t.Errorf("TryCompareAndSwap(a, 1, 2) = %v, %v, want true, nil", ok, err)
+	}
+	if v, loaded, err := m.TryLoadOrCompute("b", func() int { return 3 }); err != nil || loaded || v != 3 {
+		t.Errorf("TryLoadOrCompute(b) = %v, %v, %v, want 3, false, nil", v, loaded, err)
+	}
+	if v, ok, err := m.TryCompute("b", func(old int, loaded bool) (int, cmap.ComputeOp) {
+		return old + 1, cmap.ComputeUpdate
+	}); err != nil || !ok || v != 4 {
+		t.Errorf("TryCompute(b) = %v, %v, %v, want 4, true, nil", v, ok, err)
+	}
+	if ok, err := m.TryCompareAndDelete("b", 4); err != nil || !ok {
+		t.Errorf("TryCompareAndDelete(b, 4) = %v, %v, want true, nil", ok, err)
+	}
+
+	// Keys whose type holds no interface are hashable, and are not inspected.
+	if n := testing.AllocsPerRun(16, func() {
+		if err := cmap.CheckKey(session{1, 1, "a"}); err != nil {
+			t.Errorf("CheckKey(session) = %v, want nil", err)
+		}
+	}); n != 0 {
+		t.Errorf("CheckKey(session) allocated %v times, want 0", n)
+	}
+}
+
+// TestCMapResizeStress runs Store, LoadAndDelete, Load and Range through many
+// forced grows and shrinks, and checks that no entry is ever lost or
+// resurrected. Each writer owns the keys k%writers == w, so it can keep an
+// exact model of them.
+func TestCMapResizeStress(t *testing.T) {
+	const (
+		writers = 4
+		keys    = 1 << 10
+	)
+	ops := 1 << 14
+	if testing.Short() {
+		ops = 1 << 11
+	}
+
+	for _, mode := range []cmap.EvacuateMode{cmap.EvacuateBackground, cmap.EvacuateIncremental, cmap.EvacuateSync} {
+		m, err := cmap.NewCMapWithOptions[int, int](cmap.WithEvacuateMode(mode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		models := make([]map[int]int, writers)
+		done := make(chan struct{})
+		var wg, bg sync.WaitGroup
+		for w := 0; w < writers; w++ {
+			models[w] = make(map[int]int)
+			wg.Add(1)
+			go func(w int, model map[int]int) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(int64(w)))
+				for i := 0; i < ops; i++ {
+					k := r.Intn(keys/writers)*writers + w
+					want, present := model[k]
+					switch r.Intn(3) {
+					case 0:
+						m.Store(k, k<<16|i)
+						model[k] = k<<16 | i
+					case 1:
+						v, loaded := m.LoadAndDelete(k)
+						if loaded != present || v != want {
+							t.Errorf("LoadAndDelete(%v) = %v, %v, want %v, %v", k, v, loaded, want, present)
+							return
+						}
+						delete(model, k)
+					case 2:
+						if v, ok := m.Load(k); ok != present || v != want {
+							t.Errorf("Load(%v) = %v, %v, want %v, %v", k, v, ok, want, present)
+							return
+						}
+					}
+				}
+			}(w, models[w])
+		}
+		bg.Add(2)
+		go func() {
+			defer bg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if i%2 == 0 {
+					m.Reserve(keys<<(i%8), false)
+				} else {
+					m.Compact(false)
+				}
+			}
+		}()
+		go func() {
+			defer bg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				seen := make(map[int]bool)
+				m.Range(func(k, v int) bool {
+					if v>>16 != k || seen[k] {
+						t.Errorf("Range saw %v: %v, seen before: %v", k, v, seen[k])
+						return false
+					}
+					seen[k] = true
+					return true
+				})
+			}
+		}()
+		wg.Wait()
+		close(done)
+		bg.Wait()
+		if t.Failed() {
+			t.Fatalf("mode %v", mode)
+		}
+
+		want := make(map[int]int)
+		for _, model := range models {
+			for k, v := range model {
+				want[k] = v
+			}
+		}
+		got := make(map[int]int)
+		m.Range(func(k, v int) bool {
+			got[k] = v
+			return true
 		})
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("mode %v: map holds %v entries, model %v", mode, len(got), len(want))
+		}
+		if n := m.Count(); n != int64(len(want)) {
+			t.Fatalf("mode %v: Count() = %v, want %v", mode, n, len(want))
+		}
 	}
 }
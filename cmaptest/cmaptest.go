@@ -0,0 +1,385 @@
+// Package cmaptest provides a conformance suite for implementations of
+// cmap.Interface, such as Map, FMap and CMap or wrappers around them.
+package cmaptest
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+	"testing/quick"
+
+	"github.com/min1324/cmap"
+)
+
+// RunConformance runs the conformance suite against the maps returned by
+// newMap, which must return a new, empty map on every call. Maps of other
+// key and value types are run by RunConformanceOf.
+//
+// The suite checks random call sequences against a built-in map, Range
+// under concurrent writes, Count and Len once writers have returned, maps
+// that grow and shrink repeatedly, which exercises the resizes of CMap, and
+// the linearizability of concurrent calls while the map resizes.
+func RunConformance(t *testing.T, newMap func() cmap.Interface[any, any]) {
+	t.Run("Model", func(t *testing.T) { testModel(t, newMap) })
+	t.Run("ConcurrentRange", func(t *testing.T) { testConcurrentRange(t, newMap) })
+	t.Run("Count", func(t *testing.T) { testCount(t, newMap) })
+	t.Run("Resize", func(t *testing.T) { testResize(t, newMap) })
+	t.Run("ConcurrentResize", func(t *testing.T) { testConcurrentResize(t, newMap) })
+	t.Run("Linearizable", func(t *testing.T) { testLinearizable(t, newMap) })
+}
+
+// testModel checks that random call sequences give the same results and
+// leave the same elements on a new map as on the model.
+func testModel(t *testing.T, newMap func() cmap.Interface[any, any]) {
+	apply := func(calls []mapCall) ([]mapResult, map[any]any) {
+		return applyCalls(newMap(), calls)
+	}
+	applyModel := func(calls []mapCall) ([]mapResult, map[any]any) {
+		return applyCalls(model{}, calls)
+	}
+	if err := quick.CheckEqual(apply, applyModel, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// testConcurrentRange checks that Range visits every key once, with a value
+// that was stored for it, while other goroutines store to the map.
+func testConcurrentRange(t *testing.T, newMap func() cmap.Interface[any, any]) {
+	const mapSize = 1 << 10
+
+	m := newMap()
+	for n := int64(1); n <= mapSize; n++ {
+		m.Store(n, n)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+	for g := int64(runtime.GOMAXPROCS(0)); g > 0; g-- {
+		r := rand.New(rand.NewSource(g))
+		wg.Add(1)
+		go func(g int64) {
+			defer wg.Done()
+			for i := int64(0); ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for n := int64(1); n < mapSize; n++ {
+					if r.Int63n(mapSize) == 0 {
+						m.Store(n, n*i*g)
+					} else {
+						m.Load(n)
+					}
+				}
+			}
+		}(g)
+	}
+
+	iters := 1 << 8
+	if testing.Short() {
+		iters = 16
+	}
+	for n := iters; n > 0; n-- {
+		seen := make(map[int64]bool, mapSize)
+		m.Range(func(k, v any) bool {
+			k64, v64 := k.(int64), v.(int64)
+			if v64%k64 != 0 {
+				t.Fatalf("while Storing multiples of %v, Range saw value %v", k, v)
+			}
+			if seen[k64] {
+				t.Fatalf("Range visited key %v twice", k)
+			}
+			seen[k64] = true
+			return true
+		})
+		if len(seen) != mapSize {
+			t.Fatalf("Range visited %v elements of %v-element Map", len(seen), mapSize)
+		}
+	}
+}
+
+// testCount runs random writes from several goroutines, with Len called
+// concurrently, and checks that once they have returned Count and Len agree
+// with a full Range.
+func testCount(t *testing.T, newMap func() cmap.Interface[any, any]) {
+	const (
+		goroutines = 8
+		keys       = 1 << 8
+	)
+	ops := 1 << 13
+	if testing.Short() {
+		ops = 1 << 10
+	}
+
+	m := newMap()
+	done := make(chan struct{})
+	lens := make(chan int)
+	go func() {
+		bad := -1
+		defer func() { lens <- bad }()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if l := m.Len(); l < 0 || l > keys {
+				bad = l
+			}
+			runtime.Gosched()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < ops; i++ {
+				k, v := r.Intn(keys), r.Intn(4)
+				switch r.Intn(8) {
+				case 0:
+					m.Store(k, v)
+				case 1:
+					m.LoadOrStore(k, v)
+				case 2:
+					m.LoadOrCompute(k, func() any { return v })
+				case 3:
+					m.Swap(k, v)
+				case 4:
+					m.CompareAndSwap(k, v, r.Intn(4))
+				case 5:
+					m.Delete(k)
+				case 6:
+					m.LoadAndDelete(k)
+				case 7:
+					m.CompareAndDelete(k, v)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(done)
+	if l := <-lens; l != -1 {
+		t.Errorf("concurrent Len() = %v, want within [0, %v]", l, keys)
+	}
+
+	checkCount(t, m)
+}
+
+// testResize grows a map to many elements and shrinks it back, checking its
+// contents at every step.
+func testResize(t *testing.T, newMap func() cmap.Interface[any, any]) {
+	size := 1 << 14
+	if testing.Short() {
+		size = 1 << 10
+	}
+
+	m := newMap()
+	checkLen(t, m, 0)
+	for round := 0; round < 2; round++ {
+		for i := 0; i < size; i++ {
+			m.Store(i, i)
+		}
+		checkLen(t, m, size)
+		for i := 0; i < size; i++ {
+			if v, ok := m.Load(i); !ok || v != i {
+				t.Fatalf("round %v: Load(%v) = %v, %v, want %v, true", round, i, v, ok, i)
+			}
+		}
+
+		// Delete all but one element, down to well below the size any
+		// resize left the map at.
+		for i := 1; i < size; i++ {
+			if v, ok := m.LoadAndDelete(i); !ok || v != i {
+				t.Fatalf("round %v: LoadAndDelete(%v) = %v, %v, want %v, true", round, i, v, ok, i)
+			}
+		}
+		checkLen(t, m, 1)
+		if v, ok := m.Load(0); !ok || v != 0 {
+			t.Fatalf("round %v: Load(0) = %v, %v, want 0, true", round, v, ok)
+		}
+		m.Delete(0)
+		checkLen(t, m, 0)
+	}
+
+	// Clear a grown map, then use it again.
+	for i := 0; i < size; i++ {
+		m.Store(i, i)
+	}
+	m.Clear()
+	checkLen(t, m, 0)
+	if v, ok := m.Load(size / 2); ok {
+		t.Fatalf("Load(%v) after Clear = %v, true, want nil, false", size/2, v)
+	}
+	if _, loaded := m.LoadOrStore(size/2, 0); loaded {
+		t.Fatalf("LoadOrStore(%v) after Clear loaded", size/2)
+	}
+	checkLen(t, m, 1)
+}
+
+// testConcurrentResize has goroutines each store and delete their own keys
+// repeatedly, so that the map grows and shrinks under them, while Range
+// checks that it only sees stored values.
+func testConcurrentResize(t *testing.T, newMap func() cmap.Interface[any, any]) {
+	const goroutines = 4
+	keys, rounds := 1<<11, 8
+	if testing.Short() {
+		keys, rounds = 1<<8, 4
+	}
+
+	m := newMap()
+	done := make(chan struct{})
+	ranged := make(chan any)
+	go func() {
+		var bad any
+		defer func() { ranged <- bad }()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			m.Range(func(k, v any) bool {
+				if v != k {
+					bad = k
+				}
+				return true
+			})
+			runtime.Gosched()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan string, goroutines)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			lo, hi := g*keys, (g+1)*keys
+			for r := 0; r < rounds; r++ {
+				for k := lo; k < hi; k++ {
+					m.Store(k, k)
+				}
+				for k := lo; k < hi; k++ {
+					if v, ok := m.Load(k); !ok || v != k {
+						errs <- "Load lost a key stored by its own goroutine"
+						return
+					}
+				}
+				for k := lo; k < hi; k++ {
+					if _, ok := m.LoadAndDelete(k); !ok {
+						errs <- "LoadAndDelete lost a key stored by its own goroutine"
+						return
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(done)
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if k := <-ranged; k != nil {
+		t.Errorf("Range saw key %v with a value never stored for it", k)
+	}
+	checkLen(t, m, 0)
+}
+
+// testLinearizable has clients run random operations on a few keys, and
+// checks the recorded histories with CheckLinearizable. Between operations
+// the clients store and then delete many keys of their own, also recorded,
+// so that the map grows and shrinks while the operations run.
+func testLinearizable(t *testing.T, newMap func() cmap.Interface[any, any]) {
+	const (
+		clients = 4
+		keys    = 4
+		ops     = 512
+		churn   = 8 // other keys stored or deleted per operation
+	)
+	rounds := 16
+	if testing.Short() {
+		rounds = 2
+	}
+
+	for round := 0; round < rounds; round++ {
+		m := newMap()
+		rec := NewRecorder(m)
+		var wg sync.WaitGroup
+		for c := 0; c < clients; c++ {
+			wg.Add(1)
+			go func(c int) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(int64(round*clients + c)))
+				base := keys + c*ops*churn
+				for i := 0; i < ops; i++ {
+					for j := 0; j < churn; j++ {
+						if k := base + i*churn + j; i < ops/2 {
+							rec.Do(c, Op{Kind: OpStore, Key: k, Value: k})
+						} else {
+							rec.Do(c, Op{Kind: OpLoadAndDelete, Key: k - ops/2*churn})
+						}
+					}
+					rec.Do(c, randOp(r, keys))
+				}
+			}(c)
+		}
+		wg.Wait()
+		if err := CheckLinearizable(rec.History()); err != nil {
+			t.Fatalf("round %v: %v", round, err)
+		}
+	}
+}
+
+// randOp returns a random operation on one of the first keys ints, with
+// values from a small range so that compares often succeed.
+func randOp(r *rand.Rand, keys int) Op {
+	op := Op{
+		Kind:  opKinds[r.Intn(len(opKinds))],
+		Key:   r.Intn(keys),
+		Value: r.Intn(4),
+	}
+	if op.Kind == OpCompareAndSwap {
+		op.New = r.Intn(4)
+	}
+	return op
+}
+
+// checkCount checks that Count and Len of m, which no goroutine writes to,
+// match the number of elements Range visits.
+func checkCount(t *testing.T, m cmap.Interface[any, any]) {
+	t.Helper()
+	n := 0
+	m.Range(func(k, v any) bool {
+		n++
+		return true
+	})
+	checkLen(t, m, n)
+}
+
+func checkLen(t *testing.T, m cmap.Interface[any, any], want int) {
+	t.Helper()
+	if got := m.Count(); got != int64(want) {
+		t.Fatalf("Count() = %v, want %v", got, want)
+	}
+	if got := m.Len(); got != want {
+		t.Fatalf("Len() = %v, want %v", got, want)
+	}
+	n := 0
+	m.Range(func(k, v any) bool {
+		n++
+		return true
+	})
+	if n != want {
+		t.Fatalf("Range visited %v elements, want %v", n, want)
+	}
+}
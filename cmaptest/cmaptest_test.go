@@ -0,0 +1,210 @@
+package cmaptest_test
+
+import (
+	"errors"
+	"hash/maphash"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/min1324/cmap"
+	"github.com/min1324/cmap/cmaptest"
+)
+
+func TestConformance(t *testing.T) {
+	t.Run("Map", func(t *testing.T) {
+		cmaptest.RunConformance(t, cmap.New[any, any])
+	})
+	t.Run("CMap", func(t *testing.T) {
+		cmaptest.RunConformance(t, cmap.NewCMap[any, any])
+	})
+	t.Run("FMap", func(t *testing.T) {
+		cmaptest.RunConformance(t, func() cmap.Interface[any, any] {
+			return cmap.NewFMap[any, any](0)
+		})
+	})
+	for _, tt := range []struct {
+		name string
+		mode cmap.EvacuateMode
+	}{
+		{"CMapIncremental", cmap.EvacuateIncremental},
+		{"CMapSync", cmap.EvacuateSync},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cmaptest.RunConformance(t, func() cmap.Interface[any, any] {
+				m, err := cmap.NewCMapWithOptions[any, any](cmap.WithEvacuateMode(tt.mode))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return m
+			})
+		})
+	}
+	t.Run("CMapTyped", func(t *testing.T) {
+		cmaptest.RunConformanceOf(t, cmap.NewCMap[string, int], strconv.Itoa, func(i int) int { return i })
+	})
+	t.Run("FMapTyped", func(t *testing.T) {
+		cmaptest.RunConformanceOf(t, func() cmap.Interface[[2]int32, int64] {
+			return cmap.NewFMap[[2]int32, int64](0)
+		}, func(i int) [2]int32 { return [2]int32{int32(i), -1} }, func(i int) int64 { return int64(i) })
+	})
+	t.Run("CMapHasher", func(t *testing.T) {
+		cmaptest.RunConformance(t, func() cmap.Interface[any, any] {
+			m, err := cmap.NewCMapWithOptions[any, any](cmap.WithHasher[any](collidingHasher{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return m
+		})
+	})
+	t.Run("FMapHasher", func(t *testing.T) {
+		cmaptest.RunConformance(t, func() cmap.Interface[any, any] {
+			return cmap.NewFMapWithHasher[any, any](0, collidingHasher{})
+		})
+	})
+}
+
+// collidingHasher hashes keys to a few values only, so that many keys share
+// a hash and the maps keep them in the same entries.
+type collidingHasher struct{}
+
+func (collidingHasher) Hash(seed maphash.Seed, k any) uint64 {
+	return maphash.Comparable(seed, k) % 61
+}
+
+func (collidingHasher) Equal(a, b any) bool {
+	return a == b
+}
+
+func TestCheckLinearizable(t *testing.T) {
+	store := func(client int, v any, call, ret time.Duration) cmaptest.Operation {
+		return cmaptest.Operation{
+			Client: client,
+			Op:     cmaptest.Op{Kind: cmaptest.OpStore, Key: "k", Value: v},
+			Call:   call,
+			Return: ret,
+		}
+	}
+	load := func(client int, v any, ok bool, call, ret time.Duration) cmaptest.Operation {
+		return cmaptest.Operation{
+			Client: client,
+			Op:     cmaptest.Op{Kind: cmaptest.OpLoad, Key: "k"},
+			Value:  v,
+			Ok:     ok,
+			Call:   call,
+			Return: ret,
+		}
+	}
+	loadOrStore := func(client int, v any, loaded bool, call, ret time.Duration) cmaptest.Operation {
+		return cmaptest.Operation{
+			Client: client,
+			Op:     cmaptest.Op{Kind: cmaptest.OpLoadOrStore, Key: "k", Value: client},
+			Value:  v,
+			Ok:     loaded,
+			Call:   call,
+			Return: ret,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		history []cmaptest.Operation
+		want    bool
+	}{
+		{"empty", nil, true},
+		{
+			"sequential",
+			[]cmaptest.Operation{store(0, 1, 0, 1), load(1, 1, true, 2, 3)},
+			true,
+		},
+		{
+			"stale load",
+			[]cmaptest.Operation{store(0, 1, 0, 1), load(1, nil, false, 2, 3)},
+			false,
+		},
+		{
+			"load overlapping store",
+			[]cmaptest.Operation{store(0, 1, 0, 3), load(1, nil, false, 1, 2)},
+			true,
+		},
+		{
+			"load of a later store",
+			[]cmaptest.Operation{load(1, 2, true, 0, 1), store(0, 2, 2, 3)},
+			false,
+		},
+		{
+			"loads disagree on order",
+			[]cmaptest.Operation{
+				store(0, 1, 0, 10),
+				store(1, 2, 0, 10),
+				load(2, 1, true, 1, 2),
+				load(2, 2, true, 3, 4),
+				load(3, 2, true, 1, 2),
+				load(3, 1, true, 3, 4),
+			},
+			false,
+		},
+		{
+			"both LoadOrStore store",
+			[]cmaptest.Operation{loadOrStore(0, 0, false, 0, 2), loadOrStore(1, 1, false, 1, 3)},
+			false,
+		},
+		{
+			"one LoadOrStore loads",
+			[]cmaptest.Operation{loadOrStore(0, 1, true, 0, 2), loadOrStore(1, 1, false, 1, 3)},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := cmaptest.CheckLinearizable(tt.history)
+			if got := err == nil; got != tt.want {
+				t.Errorf("CheckLinearizable() = %v, want linearizable %v", err, tt.want)
+			}
+			var nle *cmaptest.NonLinearizableError
+			if err != nil && !errors.As(err, &nle) {
+				t.Errorf("CheckLinearizable() = %T, want *NonLinearizableError", err)
+			}
+		})
+	}
+}
+
+// racyMap is a map whose LoadOrStore is a Load and then a Store, which is
+// not atomic.
+type racyMap struct {
+	cmap.Interface[any, any]
+}
+
+func (m racyMap) LoadOrStore(key, value any) (actual any, loaded bool) {
+	if v, ok := m.Load(key); ok {
+		return v, true
+	}
+	runtime.Gosched()
+	m.Store(key, value)
+	return value, false
+}
+
+func TestCheckLinearizableRacyMap(t *testing.T) {
+	// The two calls race only if they overlap, so try a few times.
+	for attempt := 0; attempt < 100; attempt++ {
+		rec := cmaptest.NewRecorder(racyMap{cmap.NewCMap[any, any]()})
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for c := 0; c < 2; c++ {
+			wg.Add(1)
+			go func(c int) {
+				defer wg.Done()
+				<-start
+				rec.Do(c, cmaptest.Op{Kind: cmaptest.OpLoadOrStore, Key: 0, Value: c})
+			}(c)
+		}
+		close(start)
+		wg.Wait()
+		if err := cmaptest.CheckLinearizable(rec.History()); err != nil {
+			return
+		}
+	}
+	t.Error("CheckLinearizable() = nil for every history of racyMap")
+}
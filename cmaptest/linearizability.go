@@ -0,0 +1,364 @@
+package cmaptest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/min1324/cmap"
+)
+
+// Op is a call on a single key of a map.
+type Op struct {
+	Kind OpKind
+	Key  any
+
+	// Value is the value stored by Store, LoadOrStore, LoadOrCompute and
+	// Swap, and the old value compared by CompareAndSwap and CompareAndDelete.
+	Value any
+
+	// New is the value stored by CompareAndSwap.
+	New any
+}
+
+func (op Op) String() string {
+	switch op.Kind {
+	case OpLoad, OpDelete, OpLoadAndDelete:
+		return fmt.Sprintf("%v(%v)", op.Kind, op.Key)
+	case OpCompareAndSwap:
+		return fmt.Sprintf("%v(%v, %v, %v)", op.Kind, op.Key, op.Value, op.New)
+	}
+	return fmt.Sprintf("%v(%v, %v)", op.Kind, op.Key, op.Value)
+}
+
+// Operation is an Op as run by a client, with its results and the times it
+// was called and returned at.
+type Operation struct {
+	Client int
+	Op     Op
+
+	// Value and Ok are the results of the call. Value is the value loaded,
+	// Ok the ok, loaded, swapped or deleted result; calls without a result
+	// leave them zero.
+	Value any
+	Ok    bool
+
+	// Call and Return are the times, since the recorder was made, just
+	// before the call and just after it returned.
+	Call, Return time.Duration
+}
+
+func (o Operation) String() string {
+	return fmt.Sprintf("client %v: %v = %v, %v [%v, %v]", o.Client, o.Op, o.Value, o.Ok, o.Call, o.Return)
+}
+
+// Recorder runs operations on a map and records them in a history, to be
+// checked by CheckLinearizable. It is safe for concurrent use.
+type Recorder struct {
+	m     cmap.Interface[any, any]
+	start time.Time
+
+	mu  sync.Mutex
+	ops []Operation
+}
+
+// NewRecorder returns a recorder of operations on m.
+func NewRecorder(m cmap.Interface[any, any]) *Recorder {
+	return &Recorder{m: m, start: time.Now()}
+}
+
+// Do runs op on the map for client and records it.
+func (r *Recorder) Do(client int, op Op) (value any, ok bool) {
+	call := time.Since(r.start)
+	switch op.Kind {
+	case OpLoad:
+		value, ok = r.m.Load(op.Key)
+	case OpStore:
+		r.m.Store(op.Key, op.Value)
+	case OpLoadOrStore:
+		value, ok = r.m.LoadOrStore(op.Key, op.Value)
+	case OpLoadOrCompute:
+		value, ok = r.m.LoadOrCompute(op.Key, func() any { return op.Value })
+	case OpLoadAndDelete:
+		value, ok = r.m.LoadAndDelete(op.Key)
+	case OpDelete:
+		r.m.Delete(op.Key)
+	case OpSwap:
+		value, ok = r.m.Swap(op.Key, op.Value)
+	case OpCompareAndSwap:
+		ok = r.m.CompareAndSwap(op.Key, op.Value, op.New)
+	case OpCompareAndDelete:
+		ok = r.m.CompareAndDelete(op.Key, op.Value)
+	default:
+		panic("cmaptest: can not record " + string(op.Kind))
+	}
+	ret := time.Since(r.start)
+
+	r.mu.Lock()
+	r.ops = append(r.ops, Operation{
+		Client: client,
+		Op:     op,
+		Value:  value,
+		Ok:     ok,
+		Call:   call,
+		Return: ret,
+	})
+	r.mu.Unlock()
+	return value, ok
+}
+
+// History returns the operations recorded so far.
+func (r *Recorder) History() []Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Operation(nil), r.ops...)
+}
+
+// NonLinearizableError reports the operations on a key that no sequential
+// order, consistent with their call and return times, can explain.
+type NonLinearizableError struct {
+	Key        any
+	Operations []Operation // in order of call
+}
+
+func (e *NonLinearizableError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "cmaptest: history of key %v is not linearizable:", e.Key)
+	for _, o := range e.Operations {
+		b.WriteString("\n\t")
+		b.WriteString(o.String())
+	}
+	return b.String()
+}
+
+// CheckLinearizable checks that history, of operations on a map that was
+// empty when they started, is linearizable: that each operation can be
+// taken to happen at once, at some point between its call and its return,
+// and the results then match those of a sequential map.
+//
+// The operations on different keys of a map are independent, so history is
+// checked one key at a time. It returns a *NonLinearizableError for the
+// first key that fails, and nil if none does. The values in history must be
+// comparable.
+func CheckLinearizable(history []Operation) error {
+	var keys []any
+	byKey := make(map[any][]Operation)
+	for _, o := range history {
+		if _, ok := byKey[o.Op.Key]; !ok {
+			keys = append(keys, o.Op.Key)
+		}
+		byKey[o.Op.Key] = append(byKey[o.Op.Key], o)
+	}
+	for _, k := range keys {
+		ops := byKey[k]
+		if !linearizable(ops) {
+			sort.SliceStable(ops, func(i, j int) bool { return ops[i].Call < ops[j].Call })
+			return &NonLinearizableError{Key: k, Operations: ops}
+		}
+	}
+	return nil
+}
+
+// keyState is the state of a single key of the sequential map model.
+type keyState struct {
+	value any
+	ok    bool // the key is present
+}
+
+// step applies o to s, and reports whether the results of o are those of the
+// model in state s.
+func step(s keyState, o Operation) (keyState, bool) {
+	op := o.Op
+	switch op.Kind {
+	case OpLoad:
+		return s, o.Value == s.value && o.Ok == s.ok
+	case OpStore:
+		return keyState{op.Value, true}, true
+	case OpLoadOrStore, OpLoadOrCompute:
+		if s.ok {
+			return s, o.Value == s.value && o.Ok
+		}
+		return keyState{op.Value, true}, o.Value == op.Value && !o.Ok
+	case OpLoadAndDelete:
+		return keyState{}, o.Value == s.value && o.Ok == s.ok
+	case OpDelete:
+		return keyState{}, true
+	case OpSwap:
+		return keyState{op.Value, true}, o.Value == s.value && o.Ok == s.ok
+	case OpCompareAndSwap:
+		if s.ok && s.value == op.Value {
+			return keyState{op.New, true}, o.Ok
+		}
+		return s, !o.Ok
+	case OpCompareAndDelete:
+		if s.ok && s.value == op.Value {
+			return keyState{}, o.Ok
+		}
+		return s, !o.Ok
+	}
+	panic("cmaptest: can not check " + string(op.Kind))
+}
+
+// entry is the call or return of an operation in the list the search of
+// linearizable runs on.
+type entry struct {
+	id         int // index of the operation
+	call       bool
+	match      *entry // the return of a call
+	prev, next *entry
+}
+
+// lift removes the call e and its return from the list.
+func (e *entry) lift() {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	r := e.match
+	r.prev.next = r.next
+	if r.next != nil {
+		r.next.prev = r.prev
+	}
+}
+
+// unlift puts back the call e and its return, as removed by lift.
+func (e *entry) unlift() {
+	r := e.match
+	r.prev.next = r
+	if r.next != nil {
+		r.next.prev = r
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+// linearizable reports whether ops, all on the same key, are linearizable.
+//
+// It is the search of Wing and Gong, with the memoization of Lowe, as done
+// by Porcupine: walk the calls in order of time and try to linearize each in
+// turn, backtracking at the first return of an operation not linearized
+// yet. A set of linearized operations and the state they leave is only
+// tried once.
+func linearizable(ops []Operation) bool {
+	n := len(ops)
+	type event struct {
+		t    time.Duration
+		call bool
+		id   int
+	}
+	events := make([]event, 0, 2*n)
+	for i, o := range ops {
+		events = append(events, event{o.Call, true, i}, event{o.Return, false, i})
+	}
+	sort.Slice(events, func(i, j int) bool {
+		a, b := events[i], events[j]
+		if a.t != b.t {
+			return a.t < b.t
+		}
+		// Operations that touch are taken to overlap.
+		return a.call && !b.call
+	})
+
+	head := &entry{id: -1}
+	calls := make([]*entry, n)
+	last := head
+	for _, ev := range events {
+		e := &entry{id: ev.id, call: ev.call, prev: last}
+		if ev.call {
+			calls[ev.id] = e
+		} else {
+			calls[ev.id].match = e
+		}
+		last.next = e
+		last = e
+	}
+
+	type frame struct {
+		e     *entry
+		state keyState
+	}
+	type memo struct {
+		linearized bitset
+		state      keyState
+	}
+	var (
+		state      keyState
+		stack      []frame
+		linearized = newBitset(n)
+		seen       = make(map[uint64][]memo)
+	)
+	// visit reports whether the search has not yet been at linearized, in
+	// state s, and marks it as visited.
+	visit := func(s keyState) bool {
+		h := linearized.hash()
+		for _, m := range seen[h] {
+			if m.state == s && m.linearized.equal(linearized) {
+				return false
+			}
+		}
+		seen[h] = append(seen[h], memo{linearized.clone(), s})
+		return true
+	}
+
+	e := head.next
+	for head.next != nil {
+		if e.call {
+			if next, ok := step(state, ops[e.id]); ok {
+				linearized.set(e.id)
+				if visit(next) {
+					stack = append(stack, frame{e, state})
+					state = next
+					e.lift()
+					e = head.next
+					continue
+				}
+				linearized.clear(e.id)
+			}
+			e = e.next
+		} else {
+			// The operation e returns from can not be linearized after
+			// those linearized so far: undo the last of them.
+			if len(stack) == 0 {
+				return false
+			}
+			f := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			state = f.state
+			linearized.clear(f.e.id)
+			f.e.unlift()
+			e = f.e.next
+		}
+	}
+	return true
+}
+
+// bitset is a set of operations.
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << (i % 64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << (i % 64) }
+
+func (b bitset) clone() bitset {
+	return append(bitset(nil), b...)
+}
+
+func (b bitset) equal(c bitset) bool {
+	for i := range b {
+		if b[i] != c[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	h := uint64(14695981039346656037)
+	for _, w := range b {
+		h = (h ^ w) * 1099511628211
+	}
+	return h
+}
@@ -0,0 +1,214 @@
+package cmaptest
+
+import (
+	"math/rand"
+	"reflect"
+
+	"github.com/min1324/cmap"
+)
+
+// OpKind is the method of cmap.Interface an operation calls.
+type OpKind string
+
+const (
+	OpLoad             = OpKind("Load")
+	OpStore            = OpKind("Store")
+	OpLoadOrStore      = OpKind("LoadOrStore")
+	OpLoadOrCompute    = OpKind("LoadOrCompute")
+	OpLoadAndDelete    = OpKind("LoadAndDelete")
+	OpDelete           = OpKind("Delete")
+	OpSwap             = OpKind("Swap")
+	OpCompareAndSwap   = OpKind("CompareAndSwap")
+	OpCompareAndDelete = OpKind("CompareAndDelete")
+
+	// Clear and Count act on the whole map, so they are only generated by
+	// the model check and can not be recorded in a history.
+	opClear = OpKind("Clear")
+	opCount = OpKind("Count")
+)
+
+// opKinds are the kinds of the operations on a single key.
+var opKinds = [...]OpKind{
+	OpLoad,
+	OpStore,
+	OpLoadOrStore,
+	OpLoadOrCompute,
+	OpLoadAndDelete,
+	OpDelete,
+	OpSwap,
+	OpCompareAndSwap,
+	OpCompareAndDelete,
+}
+
+// mapCall is a quick.Generator for calls on cmap.Interface.
+type mapCall struct {
+	op   OpKind
+	k, v any
+}
+
+func (c mapCall) apply(m cmap.Interface[any, any]) (any, bool) {
+	switch c.op {
+	case OpLoad:
+		return m.Load(c.k)
+	case OpStore:
+		m.Store(c.k, c.v)
+		return nil, false
+	case OpLoadOrStore:
+		return m.LoadOrStore(c.k, c.v)
+	case OpLoadOrCompute:
+		return m.LoadOrCompute(c.k, func() any { return c.v })
+	case OpLoadAndDelete:
+		return m.LoadAndDelete(c.k)
+	case OpDelete:
+		m.Delete(c.k)
+		return nil, false
+	case OpSwap:
+		return m.Swap(c.k, c.v)
+	case OpCompareAndSwap:
+		if m.CompareAndSwap(c.k, c.v, rand.Int()) {
+			m.Delete(c.k)
+			return c.v, true
+		}
+		return nil, false
+	case OpCompareAndDelete:
+		if m.CompareAndDelete(c.k, c.v) {
+			if _, ok := m.Load(c.k); !ok {
+				return nil, true
+			}
+		}
+		return nil, false
+	case opClear:
+		m.Clear()
+		return nil, false
+	case opCount:
+		return m.Count(), m.Len() == int(m.Count())
+	default:
+		panic("invalid OpKind")
+	}
+}
+
+type mapResult struct {
+	value any
+	ok    bool
+}
+
+func randValue(r *rand.Rand) any {
+	b := make([]byte, r.Intn(4))
+	for i := range b {
+		b[i] = 'a' + byte(r.Intn(26))
+	}
+	return string(b)
+}
+
+func (mapCall) Generate(r *rand.Rand, size int) reflect.Value {
+	c := mapCall{op: opKinds[r.Intn(len(opKinds))], k: randValue(r)}
+	switch r.Intn(64) {
+	case 0:
+		// Clear is rare, so that most sequences build up some state.
+		c.op = opClear
+	case 1, 2, 3, 4:
+		c.op = opCount
+	}
+	switch c.op {
+	case OpStore, OpLoadOrStore, OpLoadOrCompute, OpSwap, OpCompareAndSwap, OpCompareAndDelete:
+		c.v = randValue(r)
+	}
+	return reflect.ValueOf(c)
+}
+
+func applyCalls(m cmap.Interface[any, any], calls []mapCall) (results []mapResult, final map[any]any) {
+	for _, c := range calls {
+		v, ok := c.apply(m)
+		results = append(results, mapResult{v, ok})
+	}
+
+	final = make(map[any]any)
+	m.Range(func(k, v any) bool {
+		final[k] = v
+		return true
+	})
+
+	return results, final
+}
+
+// model is the reference implementation of cmap.Interface the suite checks
+// against: a built-in map, not safe for concurrent use.
+type model map[any]any
+
+func (m model) Load(key any) (value any, ok bool) {
+	value, ok = m[key]
+	return
+}
+
+func (m model) Store(key, value any) {
+	m[key] = value
+}
+
+func (m model) LoadOrStore(key, value any) (actual any, loaded bool) {
+	if actual, loaded = m[key]; loaded {
+		return actual, true
+	}
+	m[key] = value
+	return value, false
+}
+
+func (m model) LoadOrCompute(key any, valueFn func() any) (actual any, loaded bool) {
+	if actual, loaded = m[key]; loaded {
+		return actual, true
+	}
+	actual = valueFn()
+	m[key] = actual
+	return actual, false
+}
+
+func (m model) Swap(key, value any) (previous any, loaded bool) {
+	previous, loaded = m[key]
+	m[key] = value
+	return
+}
+
+func (m model) CompareAndSwap(key, old, new any) (swapped bool) {
+	if v, ok := m[key]; !ok || v != old {
+		return false
+	}
+	m[key] = new
+	return true
+}
+
+func (m model) CompareAndDelete(key, old any) (deleted bool) {
+	if v, ok := m[key]; !ok || v != old {
+		return false
+	}
+	delete(m, key)
+	return true
+}
+
+func (m model) Delete(key any) {
+	delete(m, key)
+}
+
+func (m model) LoadAndDelete(key any) (value any, loaded bool) {
+	value, loaded = m[key]
+	delete(m, key)
+	return
+}
+
+func (m model) Clear() {
+	clear(m)
+}
+
+func (m model) Range(f func(key, value any) bool) {
+	for k, v := range m {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+func (m model) Count() int64 {
+	return int64(len(m))
+}
+
+func (m model) Len() int {
+	return len(m)
+}
@@ -0,0 +1,137 @@
+package cmaptest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/min1324/cmap"
+)
+
+// RunConformanceOf runs the conformance suite, as RunConformance does,
+// against maps of typed keys and values. The suite makes up its own keys and
+// values, of several types; each one it uses is given, in turn, the key key(i)
+// or the value value(i), for i = 0, 1, 2 and so on. key and value must return
+// a different K or V for every i.
+func RunConformanceOf[K, V comparable](t *testing.T, newMap func() cmap.Interface[K, V], key func(int) K, value func(int) V) {
+	RunConformance(t, func() cmap.Interface[any, any] {
+		return &typed[K, V]{
+			m:    newMap(),
+			keys: newCodec(key),
+			vals: newCodec(value),
+		}
+	})
+}
+
+// typed adapts a map of typed keys and values to the suite, translating the
+// keys and values of the suite by its codecs.
+type typed[K, V comparable] struct {
+	m    cmap.Interface[K, V]
+	keys *codec[K]
+	vals *codec[V]
+}
+
+// codec pairs the values the suite uses, in the order it first uses them,
+// with the values gen returns.
+type codec[T comparable] struct {
+	mu   sync.Mutex
+	gen  func(int) T
+	to   map[any]T
+	from map[T]any
+}
+
+func newCodec[T comparable](gen func(int) T) *codec[T] {
+	return &codec[T]{gen: gen, to: make(map[any]T), from: make(map[T]any)}
+}
+
+// encode returns the T x is paired with, pairing it with the next value of
+// gen if it has none yet.
+func (c *codec[T]) encode(x any) T {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.to[x]; ok {
+		return t
+	}
+	t := c.gen(len(c.to))
+	if _, ok := c.from[t]; ok {
+		panic(fmt.Sprintf("cmaptest: generator returned %v twice", t))
+	}
+	c.to[x], c.from[t] = t, x
+	return t
+}
+
+// decode returns the value t is paired with, or nil if ok is false, as the
+// maps return the zero value then.
+func (c *codec[T]) decode(t T, ok bool) any {
+	if !ok {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	x, found := c.from[t]
+	if !found {
+		panic(fmt.Sprintf("cmaptest: map returned %v, which it was never given", t))
+	}
+	return x
+}
+
+func (m *typed[K, V]) Load(key any) (value any, ok bool) {
+	v, ok := m.m.Load(m.keys.encode(key))
+	return m.vals.decode(v, ok), ok
+}
+
+func (m *typed[K, V]) Store(key, value any) {
+	m.m.Store(m.keys.encode(key), m.vals.encode(value))
+}
+
+func (m *typed[K, V]) LoadOrStore(key, value any) (actual any, loaded bool) {
+	v, loaded := m.m.LoadOrStore(m.keys.encode(key), m.vals.encode(value))
+	return m.vals.decode(v, true), loaded
+}
+
+func (m *typed[K, V]) LoadOrCompute(key any, valueFn func() any) (actual any, loaded bool) {
+	v, loaded := m.m.LoadOrCompute(m.keys.encode(key), func() V {
+		return m.vals.encode(valueFn())
+	})
+	return m.vals.decode(v, true), loaded
+}
+
+func (m *typed[K, V]) Swap(key, value any) (previous any, loaded bool) {
+	v, loaded := m.m.Swap(m.keys.encode(key), m.vals.encode(value))
+	return m.vals.decode(v, loaded), loaded
+}
+
+func (m *typed[K, V]) CompareAndSwap(key, old, new any) (swapped bool) {
+	return m.m.CompareAndSwap(m.keys.encode(key), m.vals.encode(old), m.vals.encode(new))
+}
+
+func (m *typed[K, V]) CompareAndDelete(key, old any) (deleted bool) {
+	return m.m.CompareAndDelete(m.keys.encode(key), m.vals.encode(old))
+}
+
+func (m *typed[K, V]) Delete(key any) {
+	m.m.Delete(m.keys.encode(key))
+}
+
+func (m *typed[K, V]) LoadAndDelete(key any) (value any, loaded bool) {
+	v, loaded := m.m.LoadAndDelete(m.keys.encode(key))
+	return m.vals.decode(v, loaded), loaded
+}
+
+func (m *typed[K, V]) Clear() {
+	m.m.Clear()
+}
+
+func (m *typed[K, V]) Range(f func(key, value any) bool) {
+	m.m.Range(func(k K, v V) bool {
+		return f(m.keys.decode(k, true), m.vals.decode(v, true))
+	})
+}
+
+func (m *typed[K, V]) Count() int64 {
+	return m.m.Count()
+}
+
+func (m *typed[K, V]) Len() int {
+	return m.m.Len()
+}
@@ -0,0 +1,142 @@
+package cmap
+
+import (
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	cacheLineSize = 64
+	maxCells      = 64 // most cells of a counter
+)
+
+// counter is a striped counter. Writers add to one of its cells, each on
+// its own cache line, so they do not contend on a single word, and sum adds
+// up the cells. The zero counter is ready for use; its cells are allocated
+// on the first add, one per P up to maxCells.
+type counter struct {
+	cells atomic.Pointer[[]counterCell]
+}
+
+type counterCell struct {
+	n int64
+	_ [cacheLineSize - 8]byte
+}
+
+func (c *counter) getCells() []counterCell {
+	if p := c.cells.Load(); p != nil {
+		return *p
+	}
+	cells := make([]counterCell, numCells())
+	if c.cells.CompareAndSwap(nil, &cells) {
+		return cells
+	}
+	return *c.cells.Load()
+}
+
+// numCells returns the number of cells of a striped counter or lock: one per
+// P, rounded up to a power of two, but no more than maxCells.
+func numCells() int {
+	n := 1
+	for n < runtime.GOMAXPROCS(0) && n < maxCells {
+		n <<= 1
+	}
+	return n
+}
+
+// add adds delta to cell i, modulo the number of cells, and returns the new
+// value of that cell times the number of cells: an estimate of the sum that
+// is accurate as long as the adds are spread evenly over the cells.
+func (c *counter) add(i uintptr, delta int64) (estimate int64) {
+	cells := c.getCells()
+	n := atomic.AddInt64(&cells[i&uintptr(len(cells)-1)].n, delta)
+	return n * int64(len(cells))
+}
+
+// addAny adds delta to a random cell, for callers that have no hash to
+// spread their adds by.
+func (c *counter) addAny(delta int64) {
+	c.add(uintptr(rand.Uint32()), delta)
+}
+
+// sum returns the sum of the cells. It is exact if no add runs concurrently.
+func (c *counter) sum() int64 {
+	p := c.cells.Load()
+	if p == nil {
+		return 0
+	}
+	var sum int64
+	for i := range *p {
+		sum += atomic.LoadInt64(&(*p)[i].n)
+	}
+	return sum
+}
+
+// load returns the values of the cells, to be subtracted later by sub.
+func (c *counter) load() []int64 {
+	p := c.cells.Load()
+	if p == nil {
+		return nil
+	}
+	vals := make([]int64, len(*p))
+	for i := range vals {
+		vals[i] = atomic.LoadInt64(&(*p)[i].n)
+	}
+	return vals
+}
+
+// sub subtracts the values returned by load from the cells.
+func (c *counter) sub(vals []int64) {
+	p := c.cells.Load()
+	for i, v := range vals {
+		atomic.AddInt64(&(*p)[i].n, -v)
+	}
+}
+
+// bigLock is a big-reader lock: writers read-lock one of its cells, each on
+// its own cache line, and lockAll stops them all by locking every cell.
+// The zero bigLock is unlocked; its cells are allocated like a counter's.
+type bigLock struct {
+	cells atomic.Pointer[[]bigLockCell]
+}
+
+type bigLockCell struct {
+	sync.RWMutex
+	_ [cacheLineSize - unsafe.Sizeof(sync.RWMutex{})%cacheLineSize]byte
+}
+
+func (l *bigLock) getCells() []bigLockCell {
+	if p := l.cells.Load(); p != nil {
+		return *p
+	}
+	cells := make([]bigLockCell, numCells())
+	if l.cells.CompareAndSwap(nil, &cells) {
+		return cells
+	}
+	return *l.cells.Load()
+}
+
+// rlock read-locks a random cell and returns it, to be read-unlocked.
+func (l *bigLock) rlock() *sync.RWMutex {
+	cells := l.getCells()
+	mu := &cells[rand.Uint32()&uint32(len(cells)-1)].RWMutex
+	mu.RLock()
+	return mu
+}
+
+func (l *bigLock) lockAll() {
+	cells := l.getCells()
+	for i := range cells {
+		cells[i].Lock()
+	}
+}
+
+func (l *bigLock) unlockAll() {
+	cells := l.getCells()
+	for i := range cells {
+		cells[i].Unlock()
+	}
+}
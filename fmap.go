@@ -1,74 +1,391 @@
 package cmap
 
 import (
+	"iter"
+	"slices"
 	"sync"
-	"sync/atomic"
 )
 
 const (
-	bBit          = 5
-	bMask uintptr = 1<<bBit - 1
+	fInitBit  = 5
+	fInitSize = 1 << fInitBit
 )
 
-// FMap has fixation len bucket map
-type FMap struct {
-	count  int64 // number of element
-	bucket [bMask + 1]sync.Map
+// FMap has fixation len bucket map.
+//
+// The number of buckets is fixed when the FMap is created by NewFMap.
+// The zero FMap is empty and ready for use with 1<<fInitBit buckets.
+// A FMap must not be copied after first use.
+type FMap[K comparable, V any] struct {
+	count  counter // number of element, in at most numCells() cells that buckets fold onto
+	init   sync.Once
+	mask   uintptr
+	seed   hashSeed
+	hasher Hasher[K]
+	bucket []fbucket
+}
+
+// fbucket holds the entries of a bucket in its sync.Map. With a hasher, the
+// sync.Map holds, by hash, the *hentries of that hash.
+type fbucket struct {
+	sync.Map
+	mu sync.RWMutex // read-locked by writes, locked by Len and LoadOrCompute
+}
+
+// NewFMap return an initialize fmap with shards buckets.
+// shards is rounded up to a power of two; if shards <= 0,
+// the default 1<<fInitBit buckets are used.
+func NewFMap[K comparable, V any](shards int) Interface[K, V] {
+	m := &FMap[K, V]{}
+	m.onceInit(shards)
+	return m
+}
+
+// NewFMapWithHasher is like NewFMap, but the map hashes and compares its keys
+// with h, see Hasher.
+func NewFMapWithHasher[K comparable, V any](shards int, h Hasher[K]) Interface[K, V] {
+	m := &FMap[K, V]{hasher: h}
+	m.onceInit(shards)
+	return m
+}
+
+func (m *FMap[K, V]) onceInit(shards int) {
+	m.init.Do(func() {
+		size := fInitSize
+		if shards > 0 {
+			size = 1
+			for size < shards {
+				size <<= 1
+			}
+		}
+		m.mask = uintptr(size - 1)
+		m.seed = newSeed[K]()
+		m.bucket = make([]fbucket, size)
+	})
+}
+
+// hash returns the hash of key under the seed of m.
+func (m *FMap[K, V]) hash(key K) uintptr {
+	m.onceInit(0)
+	if m.hasher != nil {
+		return uintptr(m.hasher.Hash(m.seed.seed, key))
+	}
+	return chash(key, m.seed)
+}
+
+func (m *FMap[K, V]) getBucket(i uintptr) *fbucket {
+	m.onceInit(0)
+	return &m.bucket[i&m.mask]
+}
+
+// hentries are the entries of a hash in a bucket of an FMap with a hasher.
+// They are never changed once stored in the bucket, only replaced.
+type hentries[K comparable, V any] struct {
+	es  []Entry[K, V]
+	one [1]Entry[K, V] // backs es when it holds a single entry
+}
+
+// oneHentry returns the hentries of a single entry, in one allocation.
+func oneHentry[K comparable, V any](key K, value V) *hentries[K, V] {
+	h := &hentries[K, V]{one: [1]Entry[K, V]{{Key: key, Value: value}}}
+	h.es = h.one[:]
+	return h
+}
+
+// hload returns the value for key in b, for a map with a hasher.
+func (m *FMap[K, V]) hload(b *fbucket, hash uintptr, key K) (value V, ok bool) {
+	p, ok := b.Load(hash)
+	if !ok {
+		return value, false
+	}
+	es := p.(*hentries[K, V]).es
+	if i := findEntry(m.hasher, es, key); i >= 0 {
+		return es[i].Value, true
+	}
+	return value, false
 }
 
-func (m *FMap) getBucket(i uintptr) *sync.Map {
-	return &m.bucket[i&bMask]
+// hupdate calls f with the value for key in b, for a map with a hasher, and
+// stores or deletes the entry as the op f returns says. The entries of a hash
+// are replaced as a whole, by CompareAndSwap, so writes share the bucket lock
+// as they do without a hasher, and f is called again if they lose a race.
+//
+// hupdate returns the value for key before the update, whether key was
+// present, and the op it applied, ComputeKeep if the entries are unchanged.
+func (m *FMap[K, V]) hupdate(b *fbucket, hash uintptr, key K, f func(old V, loaded bool) (V, ComputeOp)) (old V, loaded bool, op ComputeOp) {
+	var zero V
+	hkey := any(hash)
+	for {
+		p, found := b.Load(hkey)
+		var es []Entry[K, V]
+		if found {
+			es = p.(*hentries[K, V]).es
+		}
+		i := findEntry(m.hasher, es, key)
+		old, loaded = zero, i >= 0
+		if loaded {
+			old = es[i].Value
+		}
+		var v V
+		v, op = f(old, loaded)
+		var ns *hentries[K, V] // nil deletes the entries of hash
+		switch {
+		case op == ComputeUpdate && loaded && len(es) == 1:
+			ns = oneHentry(es[0].Key, v)
+		case op == ComputeUpdate && loaded:
+			ns = &hentries[K, V]{es: slices.Clone(es)}
+			ns.es[i].Value = v
+		case op == ComputeUpdate && len(es) == 0:
+			ns = oneHentry(key, v)
+		case op == ComputeUpdate:
+			ns = &hentries[K, V]{es: append(slices.Clip(es), Entry[K, V]{Key: key, Value: v})}
+		case op == ComputeDelete && loaded && len(es) == 2:
+			ns = oneHentry(es[1-i].Key, es[1-i].Value)
+		case op == ComputeDelete && loaded && len(es) > 2:
+			ns = &hentries[K, V]{es: slices.Delete(slices.Clone(es), i, i+1)}
+		case op == ComputeDelete && loaded:
+			// ns stays nil, deleting the last entry of hash.
+		default:
+			return old, loaded, ComputeKeep
+		}
+
+		var done bool
+		switch {
+		case !found:
+			_, raced := b.LoadOrStore(hkey, ns)
+			done = !raced
+		case ns == nil:
+			done = b.CompareAndDelete(hkey, p)
+		default:
+			done = b.CompareAndSwap(hkey, p, ns)
+		}
+		if !done {
+			continue
+		}
+		if op == ComputeUpdate && !loaded {
+			m.count.add(hash&m.mask, 1)
+		} else if op == ComputeDelete {
+			m.count.add(hash&m.mask, -1)
+		}
+		return old, loaded, op
+	}
 }
 
-// Load returns the value stored in the map for a key, or nil if no
-// value is present.
+// Load returns the value stored in the map for a key, or the zero value
+// if no value is present.
 // The ok result indicates whether value was found in the map.
-func (m *FMap) Load(key any) (value any, ok bool) {
-	hash := chash(key)
+func (m *FMap[K, V]) Load(key K) (value V, ok bool) {
+	hash := m.hash(key)
 	b := m.getBucket(hash)
-	return b.Load(key)
+	if m.hasher != nil {
+		return m.hload(b, hash, key)
+	}
+	v, ok := b.Load(key)
+	if !ok {
+		return value, false
+	}
+	value, _ = v.(V)
+	return value, true
 }
 
 // Store sets the value for a key.
-func (m *FMap) Store(key, value any) {
-	hash := chash(key)
-	b := m.getBucket(hash)
-	_, loaded := b.LoadOrStore(key, value)
-	if loaded {
-		b.Store(key, value)
-	} else {
-		atomic.AddInt64(&m.count, 1)
-	}
+func (m *FMap[K, V]) Store(key K, value V) {
+	_, _ = m.Swap(key, value)
 }
 
 // LoadOrStore returns the existing value for the key if present.
 // Otherwise, it stores and returns the given value.
 // The loaded result is true if the value was loaded, false if stored.
-func (m *FMap) LoadOrStore(key, value any) (actual any, loaded bool) {
-	hash := chash(key)
+func (m *FMap[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
+	hash := m.hash(key)
+	b := m.getBucket(hash)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if m.hasher != nil {
+		actual, loaded, _ = m.hupdate(b, hash, key, func(old V, loaded bool) (V, ComputeOp) {
+			if loaded {
+				return old, ComputeKeep
+			}
+			return value, ComputeUpdate
+		})
+		if !loaded {
+			return value, false
+		}
+		return actual, true
+	}
+	v, loaded := b.LoadOrStore(key, value)
+	if !loaded {
+		m.count.add(hash&m.mask, 1)
+	}
+	actual, _ = v.(V)
+	return actual, loaded
+}
+
+// Swap swaps the value for a key and returns the previous value if any.
+// The loaded result reports whether the key was present.
+func (m *FMap[K, V]) Swap(key K, value V) (previous V, loaded bool) {
+	hash := m.hash(key)
+	b := m.getBucket(hash)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if m.hasher != nil {
+		previous, loaded, _ = m.hupdate(b, hash, key, func(V, bool) (V, ComputeOp) {
+			return value, ComputeUpdate
+		})
+		return previous, loaded
+	}
+	v, loaded := b.Swap(key, value)
+	if !loaded {
+		m.count.add(hash&m.mask, 1)
+		return previous, false
+	}
+	previous, _ = v.(V)
+	return previous, true
+}
+
+// CompareAndSwap swaps the old and new values for key
+// if the value stored in the map is equal to old.
+// The old value must be of a comparable type.
+func (m *FMap[K, V]) CompareAndSwap(key K, old, new V) (swapped bool) {
+	hash := m.hash(key)
+	b := m.getBucket(hash)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if m.hasher != nil {
+		_, _, op := m.hupdate(b, hash, key, func(value V, loaded bool) (V, ComputeOp) {
+			if loaded && any(value) == any(old) {
+				return new, ComputeUpdate
+			}
+			return value, ComputeKeep
+		})
+		return op == ComputeUpdate
+	}
+	return b.CompareAndSwap(key, old, new)
+}
+
+// CompareAndDelete deletes the entry for key if its value is equal to old.
+// The old value must be of a comparable type.
+//
+// If there is no current value for key in the map, CompareAndDelete
+// returns false (even if the old value is the nil interface value).
+func (m *FMap[K, V]) CompareAndDelete(key K, old V) (deleted bool) {
+	hash := m.hash(key)
+	b := m.getBucket(hash)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if m.hasher != nil {
+		_, _, op := m.hupdate(b, hash, key, func(value V, loaded bool) (V, ComputeOp) {
+			if loaded && any(value) == any(old) {
+				return value, ComputeDelete
+			}
+			return value, ComputeKeep
+		})
+		return op == ComputeDelete
+	}
+	deleted = b.CompareAndDelete(key, old)
+	if deleted {
+		m.count.add(hash&m.mask, -1)
+	}
+	return deleted
+}
+
+// LoadOrCompute returns the existing value for the key if present.
+// Otherwise, it calls valueFn, stores and returns the computed value.
+// The loaded result is true if the value was loaded, false if stored.
+//
+// valueFn is only called when the key is absent, and calls for keys of the
+// same bucket are serialized, so it never runs concurrently for the same key.
+func (m *FMap[K, V]) LoadOrCompute(key K, valueFn func() V) (actual V, loaded bool) {
+	hash := m.hash(key)
 	b := m.getBucket(hash)
-	actual, loaded = b.LoadOrStore(key, value)
+	if m.hasher != nil {
+		if actual, loaded = m.hload(b, hash, key); loaded {
+			return actual, true
+		}
+		// No other write runs on b while it is locked, so hupdate does not
+		// retry and valueFn is called once.
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		var computed V
+		actual, loaded, _ = m.hupdate(b, hash, key, func(old V, loaded bool) (V, ComputeOp) {
+			if loaded {
+				return old, ComputeKeep
+			}
+			computed = valueFn()
+			return computed, ComputeUpdate
+		})
+		if !loaded {
+			return computed, false
+		}
+		return actual, true
+	}
+	if v, ok := b.Load(key); ok {
+		actual, _ = v.(V)
+		return actual, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if v, ok := b.Load(key); ok {
+		actual, _ = v.(V)
+		return actual, true
+	}
+	v, loaded := b.LoadOrStore(key, valueFn())
 	if !loaded {
-		atomic.AddInt64(&m.count, 1)
+		m.count.add(hash&m.mask, 1)
 	}
-	return
+	actual, _ = v.(V)
+	return actual, loaded
 }
 
 // Delete deletes the value for a key.
-func (m *FMap) Delete(key any) {
+func (m *FMap[K, V]) Delete(key K) {
 	m.LoadAndDelete(key)
 }
 
 // LoadAndDelete deletes the value for a key, returning the previous value if any.
 // The loaded result reports whether the key was present.
-func (m *FMap) LoadAndDelete(key any) (value any, loaded bool) {
-	hash := chash(key)
+func (m *FMap[K, V]) LoadAndDelete(key K) (value V, loaded bool) {
+	hash := m.hash(key)
 	b := m.getBucket(hash)
-	value, loaded = b.LoadAndDelete(key)
-	if loaded {
-		atomic.AddInt64(&m.count, ^int64(0))
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if m.hasher != nil {
+		value, loaded, _ = m.hupdate(b, hash, key, func(value V, _ bool) (V, ComputeOp) {
+			return value, ComputeDelete
+		})
+		return value, loaded
+	}
+	v, loaded := b.LoadAndDelete(key)
+	if !loaded {
+		return value, false
+	}
+	m.count.add(hash&m.mask, -1)
+	value, _ = v.(V)
+	return value, true
+}
+
+// Clear deletes all the entries, resulting in an empty FMap.
+//
+// Clear deletes the entries bucket by bucket, so entries stored
+// concurrently with Clear may survive it.
+func (m *FMap[K, V]) Clear() {
+	m.onceInit(0)
+	for i := range m.bucket {
+		b := &m.bucket[i]
+		b.mu.RLock()
+		b.Range(func(key, _ any) bool {
+			v, loaded := b.LoadAndDelete(key)
+			switch {
+			case !loaded:
+			case m.hasher != nil:
+				m.count.add(uintptr(i), -int64(len(v.(*hentries[K, V]).es)))
+			default:
+				m.count.add(uintptr(i), -1)
+			}
+			return true
+		})
+		b.mu.RUnlock()
 	}
-	return
 }
 
 // Range calls f sequentially for each key and value present in the map.
@@ -81,12 +398,23 @@ func (m *FMap) LoadAndDelete(key any) (value any, loaded bool) {
 //
 // Range may be O(N) with the number of elements in the map even if f returns
 // false after a constant number of calls.
-func (m *FMap) Range(f func(key, value any) bool) {
+func (m *FMap[K, V]) Range(f func(key K, value V) bool) {
+	m.onceInit(0)
 	var flag = true
-	for i := 0; i <= len(m.bucket); i++ {
-		b := m.getBucket(uintptr(i))
+	for i := range m.bucket {
+		b := &m.bucket[i]
 		b.Range(func(key, value any) bool {
-			flag = f(key, value)
+			if m.hasher != nil {
+				for _, e := range value.(*hentries[K, V]).es {
+					if flag = f(e.Key, e.Value); !flag {
+						break
+					}
+				}
+				return flag
+			}
+			k, _ := key.(K)
+			v, _ := value.(V)
+			flag = f(k, v)
 			return flag
 		})
 		if !flag {
@@ -95,7 +423,54 @@ func (m *FMap) Range(f func(key, value any) bool) {
 	}
 }
 
+// All returns an iterator over each key and value present in the map.
+// It has the same guarantees as Range: no key is visited more than once.
+func (m *FMap[K, V]) All() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		m.Range(yield)
+	}
+}
+
+// Keys returns an iterator over each key present in the map.
+// It has the same guarantees as Range: no key is visited more than once.
+func (m *FMap[K, V]) Keys() iter.Seq[K] {
+	return func(yield func(K) bool) {
+		m.Range(func(key K, _ V) bool {
+			return yield(key)
+		})
+	}
+}
+
+// Values returns an iterator over the value of each key present in the map.
+// It has the same guarantees as Range: no key is visited more than once.
+func (m *FMap[K, V]) Values() iter.Seq[V] {
+	return func(yield func(V) bool) {
+		m.Range(func(_ K, value V) bool {
+			return yield(value)
+		})
+	}
+}
+
 // Count returns the number of elements within the map.
-func (m *FMap) Count() int64 {
-	return atomic.LoadInt64(&m.count)
+//
+// Count is cheap and never blocks, but it is approximate while the map is
+// being modified: it is only exact once all operations have returned.
+// Use Len for an exact number.
+func (m *FMap[K, V]) Count() int64 {
+	return m.count.sum()
+}
+
+// Len returns the number of elements within the map. Unlike Count, it is
+// exact: it locks every bucket, waiting for the writes in progress, and
+// blocks writers until it has summed the count.
+func (m *FMap[K, V]) Len() int {
+	m.onceInit(0)
+	for i := range m.bucket {
+		m.bucket[i].mu.Lock()
+	}
+	l := m.count.sum()
+	for i := range m.bucket {
+		m.bucket[i].mu.Unlock()
+	}
+	return int(l)
 }
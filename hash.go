@@ -1,19 +1,181 @@
 package cmap
 
-import "unsafe"
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"math/bits"
+	"math/rand/v2"
+	"reflect"
+	"unsafe"
+)
 
-func chash(i any) uintptr {
-	return nilinterhash(noescape(unsafe.Pointer(&i)), 0xdeadbeef)
+// hashSeed is the seed keys of a map are hashed with.
+type hashSeed struct {
+	seed   maphash.Seed
+	k0, k1 uint64 // keys of the integer fast path, k1 is odd
+	mem    uint8  // if not 0, keys are hashed by their memory, read mem bytes at a time
 }
 
-// in runtime/alg.go
+// newSeed returns a random hash seed, so that the bucket of a key can not be
+// predicted from outside the map.
+func newSeed[K comparable]() hashSeed {
+	return hashSeed{
+		seed: maphash.MakeSeed(),
+		k0:   rand.Uint64(),
+		k1:   rand.Uint64() | 1,
+		mem:  memWidth(reflect.TypeFor[K]()),
+	}
+}
+
+// memWidth returns how many bytes at a time keys of t are best read to be
+// hashed by their memory, or 0 if they hash faster by maphash.Comparable.
+// Only keys of 1, 2, 4, 8 or 16 bytes that are memHashable are read. A struct
+// key is copied field by field, and reading fields back by wider loads stalls
+// them, so a struct is read as wide as its narrowest field, 4 or 8 bytes.
+func memWidth(t reflect.Type) uint8 {
+	if !memHashable(t) {
+		return 0
+	}
+	size := t.Size()
+	w := size
+	if t.Kind() == reflect.Struct {
+		w = fieldWidth(t)
+	}
+	switch {
+	case size <= 4 && w == size && size != 3:
+		return uint8(size)
+	case size == 8 || size == 16:
+		if w >= 8 {
+			return 8
+		}
+		if w == 4 {
+			return 4
+		}
+	}
+	return 0
+}
+
+// fieldWidth returns the size of the narrowest field of t, looking into
+// nested structs and arrays, or the size of t if it has no fields.
+func fieldWidth(t reflect.Type) uintptr {
+	switch t.Kind() {
+	case reflect.Array:
+		return fieldWidth(t.Elem())
+	case reflect.Struct:
+		w := t.Size()
+		for i := 0; i < t.NumField(); i++ {
+			w = min(w, fieldWidth(t.Field(i).Type))
+		}
+		return w
+	}
+	return t.Size()
+}
+
+// memHashable reports whether two values of t are equal exactly when their
+// memory is, so they can be hashed as bytes: t holds no padding, pointers,
+// floats or interfaces.
+func memHashable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	case reflect.Array:
+		return memHashable(t.Elem())
+	case reflect.Struct:
+		var size uintptr
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Name == "_" || f.Offset != size || !memHashable(f.Type) {
+				return false
+			}
+			size += f.Type.Size()
+		}
+		return size == t.Size()
+	}
+	return false
+}
+
+// chash returns the hash of key under seed.
 //
-//go:linkname nilinterhash runtime.nilinterhash
-func nilinterhash(p unsafe.Pointer, h uintptr) uintptr
-
-//go:nocheckptr
-//go:nosplit
-func noescape(p unsafe.Pointer) unsafe.Pointer {
-	x := uintptr(p)
-	return unsafe.Pointer(x ^ 0)
+// Strings and integers take a fast path, and so do small keys that are plain
+// memory, like named integers, 16-byte arrays and structs of integers, see
+// memWidth. Any other key is hashed by maphash.Comparable, the
+// same way the runtime hashes map keys.
+func chash[K comparable](key K, seed hashSeed) uintptr {
+	switch k := any(key).(type) {
+	case string:
+		return uintptr(maphash.String(seed.seed, k))
+	case int:
+		return seed.uint64(uint64(k))
+	case int64:
+		return seed.uint64(uint64(k))
+	case int32:
+		return seed.uint64(uint64(k))
+	case uint:
+		return seed.uint64(uint64(k))
+	case uint64:
+		return seed.uint64(k)
+	case uint32:
+		return seed.uint64(uint64(k))
+	case uintptr:
+		return seed.uint64(uint64(k))
+	}
+	if seed.mem != 0 {
+		b := unsafe.Slice((*byte)(unsafe.Pointer(&key)), unsafe.Sizeof(key))
+		switch len(b) {
+		case 1:
+			return seed.uint64(uint64(b[0]))
+		case 2:
+			return seed.uint64(uint64(binary.LittleEndian.Uint16(b)))
+		case 4:
+			return seed.uint64(uint64(binary.LittleEndian.Uint32(b)))
+		case 8:
+			return seed.uint64(load64(b, seed.mem))
+		default: // 16, see memWidth
+			x, y := load64(b, seed.mem), load64(b[8:], seed.mem)
+			return uintptr(mix(mix(x^seed.k0, y^seed.k1), seed.k0^seed.k1))
+		}
+	}
+	return uintptr(maphash.Comparable(seed.seed, key))
+}
+
+// load64 reads the first 8 bytes of b as an integer, w bytes at a time, where
+// w is 4 or 8.
+func load64(b []byte, w uint8) uint64 {
+	if w == 4 {
+		return uint64(binary.LittleEndian.Uint32(b)) | uint64(binary.LittleEndian.Uint32(b[4:]))<<32
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+// uint64 hashes x by two rounds of a folded 128-bit multiply, as wyhash does.
+func (s hashSeed) uint64(x uint64) uintptr {
+	return uintptr(mix(mix(x^s.k0, s.k1), s.k0^s.k1))
+}
+
+func mix(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	return hi ^ lo
+}
+
+// Hasher hashes and compares the keys of a map in place of the hash and ==
+// of the key type, for keys whose identity is only part of their value.
+// Keys that are Equal must have the same Hash.
+//
+// Hash should mix seed into the hash, as by maphash.Comparable, to keep the
+// buckets of keys unpredictable.
+type Hasher[K any] interface {
+	Hash(seed maphash.Seed, key K) uint64
+	Equal(a, b K) bool
+}
+
+// findEntry returns the index of the entry of es, the entries of a bucket
+// with some hash, whose key h reports equal to key, or -1 if there is none.
+func findEntry[K comparable, V any](h Hasher[K], es []Entry[K, V], key K) int {
+	for i := range es {
+		if h.Equal(es[i].Key, key) {
+			return i
+		}
+	}
+	return -1
 }
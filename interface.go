@@ -1,47 +1,73 @@
 package cmap
 
-type Interface interface {
-	// Load returns the value stored in the map for a key, or nil if no
-	// value is present.
+// Interface is the set of methods shared by Map, FMap and CMap.
+//
+// Map[K, V], FMap[K, V] and CMap[K, V] all implement Interface[K, V].
+type Interface[K comparable, V any] interface {
+	// Load returns the value stored in the map for a key, or the zero value
+	// if no value is present.
 	// The ok result indicates whether value was found in the map.
-	Load(key any) (value any, ok bool)
+	Load(key K) (value V, ok bool)
 
 	// Store sets the value for a key.
-	Store(key, value any)
+	Store(key K, value V)
 
 	// LoadOrStore returns the existing value for the key if present.
 	// Otherwise, it stores and returns the given value.
 	// The loaded result is true if the value was loaded, false if stored.
-	LoadOrStore(key, value any) (actual any, loaded bool)
+	LoadOrStore(key K, value V) (actual V, loaded bool)
+
+	// LoadOrCompute returns the existing value for the key if present.
+	// Otherwise, it calls valueFn, stores and returns the computed value.
+	// The loaded result is true if the value was loaded, false if stored.
+	// valueFn is only called when the key is absent, and never concurrently
+	// for the same key.
+	LoadOrCompute(key K, valueFn func() V) (actual V, loaded bool)
+
+	// Swap swaps the value for a key and returns the previous value if any.
+	// The loaded result reports whether the key was present.
+	Swap(key K, value V) (previous V, loaded bool)
+
+	// CompareAndSwap swaps the old and new values for key
+	// if the value stored in the map is equal to old.
+	// The old value must be of a comparable type.
+	CompareAndSwap(key K, old, new V) (swapped bool)
+
+	// CompareAndDelete deletes the entry for key if its value is equal to old.
+	// The old value must be of a comparable type.
+	CompareAndDelete(key K, old V) (deleted bool)
 
 	// Delete deletes the value for a key.
-	Delete(key any)
+	Delete(key K)
 
 	// LoadAndDelete deletes the value for a key, returning the previous value if any.
 	// The loaded result reports whether the key was present.
-	LoadAndDelete(key any) (value any, loaded bool)
+	LoadAndDelete(key K) (value V, loaded bool)
+
+	// Clear deletes all the entries, resulting in an empty map.
+	Clear()
 
 	// Range calls f sequentially for each key and value present in the map.
 	// If f returns false, range stops the iteration.
-	Range(f func(key, value any) bool)
+	Range(f func(key K, value V) bool)
 
-	// Count returns the number of elements within the map.
+	// Count returns the number of elements within the map. It is cheap, but
+	// only exact once all operations on the map have returned.
 	Count() int64
-}
 
-// New return an initialize map
-func New() Interface {
-	return &Map{}
+	// Len returns the number of elements within the map. It is exact, as of
+	// a single point during the call, but blocks writers while it counts.
+	Len() int
 }
 
-// NewFMap return an initialize fmap
-func NewFMap() Interface {
-	return &FMap{}
+// New return an initialize map
+func New[K comparable, V any]() Interface[K, V] {
+	return &Map[K, V]{}
 }
 
 // NewCMap return an initialize cmap
-func NewCMap() Interface {
-	m := &CMap{}
+func NewCMap[K comparable, V any]() Interface[K, V] {
+	m := &CMap[K, V]{}
 	n := m.getNode()
 	n.initBuckets()
 	return m
@@ -5,12 +5,13 @@
 package cmap
 
 import (
+	"iter"
 	"sync"
 	"sync/atomic"
 	"unsafe"
 )
 
-// Map is like a Go map[any]any but is safe for concurrent use
+// Map is like a Go map[K]V but is safe for concurrent use
 // by multiple goroutines without additional locking or coordination.
 // Loads, stores, and deletes run in amortized constant time.
 //
@@ -25,7 +26,7 @@ import (
 // contention compared to a Go map paired with a separate Mutex or RWMutex.
 //
 // The zero Map is empty and ready for use. A Map must not be copied after first use.
-type Map struct {
+type Map[K comparable, V any] struct {
 	mu sync.Mutex
 
 	// read contains the portion of the map's contents that are safe for
@@ -37,7 +38,7 @@ type Map struct {
 	// Entries stored in read may be updated concurrently without mu, but updating
 	// a previously-expunged entry requires that the entry be copied to the dirty
 	// map and unexpunged with mu held.
-	read atomic.Value // readOnly
+	read atomic.Value // readOnly[K, V]
 
 	// dirty contains the portion of the map's contents that require mu to be
 	// held. To ensure that the dirty map can be promoted to the read map quickly,
@@ -49,7 +50,7 @@ type Map struct {
 	//
 	// If the dirty map is nil, the next write to the map will initialize it by
 	// making a shallow copy of the clean map, omitting stale entries.
-	dirty map[any]*entry
+	dirty map[K]*entry[V]
 
 	// misses counts the number of loads since the read map was last updated that
 	// needed to lock mu to determine whether the key was present.
@@ -59,12 +60,19 @@ type Map struct {
 	// state) and the next store to the map will make a new dirty copy.
 	misses int
 
-	count int64
+	// count is adjusted each time an entry moves between holding a value
+	// and being deleted (nil or expunged), so it is exact once all
+	// in-flight operations have returned.
+	count counter
+
+	// lens is read-locked by every operation that may change count, so
+	// that Len can wait for them to return.
+	lens bigLock
 }
 
 // readOnly is an immutable struct stored atomically in the Map.read field.
-type readOnly struct {
-	m       map[any]*entry
+type readOnly[K comparable, V any] struct {
+	m       map[K]*entry[V]
 	amended bool // true if the dirty map contains some key not in m.
 }
 
@@ -73,8 +81,8 @@ type readOnly struct {
 var expunged = unsafe.Pointer(new(any))
 
 // An entry is a slot in the map corresponding to a particular key.
-type entry struct {
-	// p points to the any value stored for the entry.
+type entry[V any] struct {
+	// p points to the value stored for the entry.
 	//
 	// If p == nil, the entry has been deleted and m.dirty == nil.
 	//
@@ -92,25 +100,30 @@ type entry struct {
 	// p != expunged. If p == expunged, an entry's associated value can be updated
 	// only after first setting m.dirty[key] = e so that lookups using the dirty
 	// map find the entry.
-	p unsafe.Pointer // *any
+	p unsafe.Pointer // *V
+}
+
+func newEntry[V any](i V) *entry[V] {
+	return &entry[V]{p: unsafe.Pointer(&i)}
 }
 
-func newEntry(i any) *entry {
-	return &entry{p: unsafe.Pointer(&i)}
+func (m *Map[K, V]) loadReadOnly() readOnly[K, V] {
+	read, _ := m.read.Load().(readOnly[K, V])
+	return read
 }
 
-// Load returns the value stored in the map for a key, or nil if no
-// value is present.
+// Load returns the value stored in the map for a key, or the zero value
+// if no value is present.
 // The ok result indicates whether value was found in the map.
-func (m *Map) Load(key any) (value any, ok bool) {
-	read, _ := m.read.Load().(readOnly)
+func (m *Map[K, V]) Load(key K) (value V, ok bool) {
+	read := m.loadReadOnly()
 	e, ok := read.m[key]
 	if !ok && read.amended {
 		m.mu.Lock()
 		// Avoid reporting a spurious miss if m.dirty got promoted while we were
 		// blocked on m.mu. (If further loads of the same key will not miss, it's
 		// not worth copying the dirty map for this key.)
-		read, _ = m.read.Load().(readOnly)
+		read = m.loadReadOnly()
 		e, ok = read.m[key]
 		if !ok && read.amended {
 			e, ok = m.dirty[key]
@@ -122,64 +135,48 @@ func (m *Map) Load(key any) (value any, ok bool) {
 		m.mu.Unlock()
 	}
 	if !ok {
-		return nil, false
+		return value, false
 	}
 	return e.load()
 }
 
-func (e *entry) load() (value any, ok bool) {
+func (e *entry[V]) load() (value V, ok bool) {
 	p := atomic.LoadPointer(&e.p)
 	if p == nil || p == expunged {
-		return nil, false
+		return value, false
 	}
-	return *(*any)(p), true
+	return *(*V)(p), true
 }
 
 // Store sets the value for a key.
-func (m *Map) Store(key, value any) {
-	read, _ := m.read.Load().(readOnly)
-	if e, ok := read.m[key]; ok && e.tryStore(&value) {
-		return
-	}
-
-	m.mu.Lock()
-	read, _ = m.read.Load().(readOnly)
-	if e, ok := read.m[key]; ok {
-		if e.unexpungeLocked() {
-			// The entry was previously expunged, which implies that there is a
-			// non-nil dirty map and this entry is not in it.
-			m.dirty[key] = e
-			atomic.AddInt64(&m.count, 1)
-		}
-		e.storeLocked(&value)
-	} else if e, ok := m.dirty[key]; ok {
-		e.storeLocked(&value)
-	} else {
-		if !read.amended {
-			// We're adding the first new key to the dirty map.
-			// Make sure it is allocated and mark the read-only map as incomplete.
-			m.dirtyLocked()
-			m.read.Store(readOnly{m: read.m, amended: true})
-		}
-		m.dirty[key] = newEntry(value)
-		atomic.AddInt64(&m.count, 1)
-	}
-	m.mu.Unlock()
+func (m *Map[K, V]) Store(key K, value V) {
+	_, _ = m.Swap(key, value)
 }
 
-// tryStore stores a value if the entry has not been expunged.
+// tryCompareAndSwap compare the entry with the given old value and swaps
+// it with a new value if the entry is equal to the old value, and the entry
+// has not been expunged.
 //
-// If the entry is expunged, tryStore returns false and leaves the entry
-// unchanged.
-func (e *entry) tryStore(i *any) bool {
+// If the entry is expunged, tryCompareAndSwap returns false and leaves
+// the entry unchanged.
+func (e *entry[V]) tryCompareAndSwap(old, new V) bool {
+	p := atomic.LoadPointer(&e.p)
+	if p == nil || p == expunged || any(*(*V)(p)) != any(old) {
+		return false
+	}
+
+	// Copy the value after the first load to make this method more amenable
+	// to escape analysis: if the comparison fails from the start, we shouldn't
+	// bother heap-allocating a value to store.
+	nc := new
 	for {
-		p := atomic.LoadPointer(&e.p)
-		if p == expunged {
-			return false
-		}
-		if atomic.CompareAndSwapPointer(&e.p, p, unsafe.Pointer(i)) {
+		if atomic.CompareAndSwapPointer(&e.p, p, unsafe.Pointer(&nc)) {
 			return true
 		}
+		p = atomic.LoadPointer(&e.p)
+		if p == nil || p == expunged || any(*(*V)(p)) != any(old) {
+			return false
+		}
 	}
 }
 
@@ -187,36 +184,39 @@ func (e *entry) tryStore(i *any) bool {
 //
 // If the entry was previously expunged, it must be added to the dirty map
 // before m.mu is unlocked.
-func (e *entry) unexpungeLocked() (wasExpunged bool) {
+func (e *entry[V]) unexpungeLocked() (wasExpunged bool) {
 	return atomic.CompareAndSwapPointer(&e.p, expunged, nil)
 }
 
-// storeLocked unconditionally stores a value to the entry.
+// swapLocked unconditionally swaps a value into the entry.
 //
 // The entry must be known not to be expunged.
-func (e *entry) storeLocked(i *any) {
-	atomic.StorePointer(&e.p, unsafe.Pointer(i))
+func (e *entry[V]) swapLocked(i *V) *V {
+	return (*V)(atomic.SwapPointer(&e.p, unsafe.Pointer(i)))
 }
 
 // LoadOrStore returns the existing value for the key if present.
 // Otherwise, it stores and returns the given value.
 // The loaded result is true if the value was loaded, false if stored.
-func (m *Map) LoadOrStore(key, value any) (actual any, loaded bool) {
+func (m *Map[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
+	defer m.lens.rlock().RUnlock()
 	// Avoid locking if it's a clean hit.
-	read, _ := m.read.Load().(readOnly)
+	read := m.loadReadOnly()
 	if e, ok := read.m[key]; ok {
 		actual, loaded, ok := e.tryLoadOrStore(value)
 		if ok {
+			if !loaded {
+				m.count.addAny(1)
+			}
 			return actual, loaded
 		}
 	}
 
 	m.mu.Lock()
-	read, _ = m.read.Load().(readOnly)
+	read = m.loadReadOnly()
 	if e, ok := read.m[key]; ok {
 		if e.unexpungeLocked() {
 			m.dirty[key] = e
-			atomic.AddInt64(&m.count, 1)
 		}
 		actual, loaded, _ = e.tryLoadOrStore(value)
 	} else if e, ok := m.dirty[key]; ok {
@@ -227,14 +227,16 @@ func (m *Map) LoadOrStore(key, value any) (actual any, loaded bool) {
 			// We're adding the first new key to the dirty map.
 			// Make sure it is allocated and mark the read-only map as incomplete.
 			m.dirtyLocked()
-			m.read.Store(readOnly{m: read.m, amended: true})
+			m.read.Store(readOnly[K, V]{m: read.m, amended: true})
 		}
 		m.dirty[key] = newEntry(value)
 		actual, loaded = value, false
-		atomic.AddInt64(&m.count, 1)
 	}
 	m.mu.Unlock()
 
+	if !loaded {
+		m.count.addAny(1)
+	}
 	return actual, loaded
 }
 
@@ -243,16 +245,16 @@ func (m *Map) LoadOrStore(key, value any) (actual any, loaded bool) {
 //
 // If the entry is expunged, tryLoadOrStore leaves the entry unchanged and
 // returns with ok==false.
-func (e *entry) tryLoadOrStore(i any) (actual any, loaded, ok bool) {
+func (e *entry[V]) tryLoadOrStore(i V) (actual V, loaded, ok bool) {
 	p := atomic.LoadPointer(&e.p)
 	if p == expunged {
-		return nil, false, false
+		return actual, false, false
 	}
 	if p != nil {
-		return *(*any)(p), true, true
+		return *(*V)(p), true, true
 	}
 
-	// Copy the interface after the first load to make this method more amenable
+	// Copy the value after the first load to make this method more amenable
 	// to escape analysis: if we hit the "load" path or the entry is expunged, we
 	// shouldn't bother heap-allocating.
 	ic := i
@@ -262,27 +264,76 @@ func (e *entry) tryLoadOrStore(i any) (actual any, loaded, ok bool) {
 		}
 		p = atomic.LoadPointer(&e.p)
 		if p == expunged {
-			return nil, false, false
+			return actual, false, false
 		}
 		if p != nil {
-			return *(*any)(p), true, true
+			return *(*V)(p), true, true
 		}
 	}
 }
 
+// LoadOrCompute returns the existing value for the key if present.
+// Otherwise, it calls valueFn, stores and returns the computed value.
+// The loaded result is true if the value was loaded, false if stored.
+//
+// valueFn is only called when the key is absent, with m.mu held, so it never
+// runs concurrently for the same key. valueFn must not call methods on the
+// map, or it may deadlock.
+func (m *Map[K, V]) LoadOrCompute(key K, valueFn func() V) (actual V, loaded bool) {
+	defer m.lens.rlock().RUnlock()
+	// Avoid locking if it's a clean hit.
+	read := m.loadReadOnly()
+	if e, ok := read.m[key]; ok {
+		if actual, loaded = e.load(); loaded {
+			return actual, loaded
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	read = m.loadReadOnly()
+	if e, ok := read.m[key]; ok {
+		if e.unexpungeLocked() {
+			m.dirty[key] = e
+		}
+		if actual, loaded = e.load(); !loaded {
+			actual, loaded, _ = e.tryLoadOrStore(valueFn())
+		}
+	} else if e, ok := m.dirty[key]; ok {
+		if actual, loaded = e.load(); !loaded {
+			actual, loaded, _ = e.tryLoadOrStore(valueFn())
+		}
+		m.missLocked()
+	} else {
+		if !read.amended {
+			// We're adding the first new key to the dirty map.
+			// Make sure it is allocated and mark the read-only map as incomplete.
+			m.dirtyLocked()
+			m.read.Store(readOnly[K, V]{m: read.m, amended: true})
+		}
+		actual, loaded = valueFn(), false
+		m.dirty[key] = newEntry(actual)
+	}
+
+	if !loaded {
+		m.count.addAny(1)
+	}
+	return actual, loaded
+}
+
 // LoadAndDelete deletes the value for a key, returning the previous value if any.
 // The loaded result reports whether the key was present.
-func (m *Map) LoadAndDelete(key any) (value any, loaded bool) {
-	read, _ := m.read.Load().(readOnly)
+func (m *Map[K, V]) LoadAndDelete(key K) (value V, loaded bool) {
+	defer m.lens.rlock().RUnlock()
+	read := m.loadReadOnly()
 	e, ok := read.m[key]
 	if !ok && read.amended {
 		m.mu.Lock()
-		read, _ = m.read.Load().(readOnly)
+		read = m.loadReadOnly()
 		e, ok = read.m[key]
 		if !ok && read.amended {
 			e, ok = m.dirty[key]
 			delete(m.dirty, key)
-			atomic.AddInt64(&m.count, ^int64(0))
 			// Regardless of whether the entry was present, record a miss: this key
 			// will take the slow path until the dirty map is promoted to the read
 			// map.
@@ -291,26 +342,201 @@ func (m *Map) LoadAndDelete(key any) (value any, loaded bool) {
 		m.mu.Unlock()
 	}
 	if ok {
-		return e.delete()
+		value, loaded = e.delete()
+		if loaded {
+			m.count.addAny(-1)
+		}
+		return value, loaded
 	}
-	return nil, false
+	return value, false
 }
 
 // Delete deletes the value for a key.
-func (m *Map) Delete(key any) {
+func (m *Map[K, V]) Delete(key K) {
 	m.LoadAndDelete(key)
 }
 
-func (e *entry) delete() (value any, ok bool) {
+func (e *entry[V]) delete() (value V, ok bool) {
 	for {
 		p := atomic.LoadPointer(&e.p)
 		if p == nil || p == expunged {
+			return value, false
+		}
+		if atomic.CompareAndSwapPointer(&e.p, p, nil) {
+			return *(*V)(p), true
+		}
+	}
+}
+
+// trySwap swaps a value if the entry has not been expunged.
+//
+// If the entry is expunged, trySwap returns false and leaves the entry
+// unchanged.
+func (e *entry[V]) trySwap(i *V) (*V, bool) {
+	for {
+		p := atomic.LoadPointer(&e.p)
+		if p == expunged {
 			return nil, false
 		}
+		if atomic.CompareAndSwapPointer(&e.p, p, unsafe.Pointer(i)) {
+			return (*V)(p), true
+		}
+	}
+}
+
+// Swap swaps the value for a key and returns the previous value if any.
+// The loaded result reports whether the key was present.
+func (m *Map[K, V]) Swap(key K, value V) (previous V, loaded bool) {
+	defer m.lens.rlock().RUnlock()
+	read := m.loadReadOnly()
+	if e, ok := read.m[key]; ok {
+		if v, ok := e.trySwap(&value); ok {
+			if v == nil {
+				m.count.addAny(1)
+				return previous, false
+			}
+			return *v, true
+		}
+	}
+
+	m.mu.Lock()
+	read = m.loadReadOnly()
+	if e, ok := read.m[key]; ok {
+		if e.unexpungeLocked() {
+			// The entry was previously expunged, which implies that there is a
+			// non-nil dirty map and this entry is not in it.
+			m.dirty[key] = e
+		}
+		if v := e.swapLocked(&value); v != nil {
+			loaded = true
+			previous = *v
+		}
+	} else if e, ok := m.dirty[key]; ok {
+		if v := e.swapLocked(&value); v != nil {
+			loaded = true
+			previous = *v
+		}
+	} else {
+		if !read.amended {
+			// We're adding the first new key to the dirty map.
+			// Make sure it is allocated and mark the read-only map as incomplete.
+			m.dirtyLocked()
+			m.read.Store(readOnly[K, V]{m: read.m, amended: true})
+		}
+		m.dirty[key] = newEntry(value)
+	}
+	m.mu.Unlock()
+
+	if !loaded {
+		m.count.addAny(1)
+	}
+	return previous, loaded
+}
+
+// CompareAndSwap swaps the old and new values for key
+// if the value stored in the map is equal to old.
+// The old value must be of a comparable type.
+func (m *Map[K, V]) CompareAndSwap(key K, old, new V) (swapped bool) {
+	read := m.loadReadOnly()
+	if e, ok := read.m[key]; ok {
+		return e.tryCompareAndSwap(old, new)
+	} else if !read.amended {
+		return false // No existing value for key.
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	read = m.loadReadOnly()
+	swapped = false
+	if e, ok := read.m[key]; ok {
+		swapped = e.tryCompareAndSwap(old, new)
+	} else if e, ok := m.dirty[key]; ok {
+		swapped = e.tryCompareAndSwap(old, new)
+		// We needed to lock mu in order to load the entry for key,
+		// and the operation didn't change the set of keys in the map
+		// (so it would be made more efficient by promoting the dirty
+		// map to read-only).
+		// Count it as a miss so that we will eventually switch to the
+		// more efficient steady state.
+		m.missLocked()
+	}
+	return swapped
+}
+
+// CompareAndDelete deletes the entry for key if its value is equal to old.
+// The old value must be of a comparable type.
+//
+// If there is no current value for key in the map, CompareAndDelete
+// returns false (even if the old value is the nil interface value).
+func (m *Map[K, V]) CompareAndDelete(key K, old V) (deleted bool) {
+	defer m.lens.rlock().RUnlock()
+	read := m.loadReadOnly()
+	e, ok := read.m[key]
+	if !ok && read.amended {
+		m.mu.Lock()
+		read = m.loadReadOnly()
+		e, ok = read.m[key]
+		if !ok && read.amended {
+			e, ok = m.dirty[key]
+			// Don't delete key from m.dirty: we still need to do the "compare" part
+			// of the operation. The entry will eventually be expunged when the
+			// dirty map is promoted to the read map.
+			//
+			// Regardless of whether the entry was present, record a miss: this key
+			// will take the slow path until the dirty map is promoted to the read
+			// map.
+			m.missLocked()
+		}
+		m.mu.Unlock()
+	}
+	for ok {
+		p := atomic.LoadPointer(&e.p)
+		if p == nil || p == expunged || any(*(*V)(p)) != any(old) {
+			return false
+		}
 		if atomic.CompareAndSwapPointer(&e.p, p, nil) {
-			return *(*any)(p), true
+			m.count.addAny(-1)
+			return true
 		}
 	}
+	return false
+}
+
+// Clear deletes all the entries, resulting in an empty Map.
+//
+// The entries of the cleared map are expunged, so that operations which
+// loaded them before the Clear cannot resurrect them or skew Count.
+func (m *Map[K, V]) Clear() {
+	read := m.loadReadOnly()
+	if len(read.m) == 0 && !read.amended {
+		// Avoid allocating a new readOnly when the map is already clear.
+		return
+	}
+
+	defer m.lens.rlock().RUnlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	read = m.loadReadOnly()
+	m.read.Store(readOnly[K, V]{})
+	for _, e := range read.m {
+		m.expungeClearedLocked(e)
+	}
+	for _, e := range m.dirty {
+		m.expungeClearedLocked(e)
+	}
+	m.dirty = nil
+	// Don't immediately promote the newly-cleared dirty map on the next operation.
+	m.misses = 0
+}
+
+// expungeClearedLocked marks an entry dropped by Clear as expunged, so that
+// no further update can be applied to it, and removes its value from count.
+func (m *Map[K, V]) expungeClearedLocked(e *entry[V]) {
+	p := atomic.SwapPointer(&e.p, expunged)
+	if p != nil && p != expunged {
+		m.count.addAny(-1)
+	}
 }
 
 // Range calls f sequentially for each key and value present in the map.
@@ -323,21 +549,21 @@ func (e *entry) delete() (value any, ok bool) {
 //
 // Range may be O(N) with the number of elements in the map even if f returns
 // false after a constant number of calls.
-func (m *Map) Range(f func(key, value any) bool) {
+func (m *Map[K, V]) Range(f func(key K, value V) bool) {
 	// We need to be able to iterate over all of the keys that were already
 	// present at the start of the call to Range.
 	// If read.amended is false, then read.m satisfies that property without
 	// requiring us to hold m.mu for a long time.
-	read, _ := m.read.Load().(readOnly)
+	read := m.loadReadOnly()
 	if read.amended {
 		// m.dirty contains keys not in read.m. Fortunately, Range is already O(N)
 		// (assuming the caller does not break out early), so a call to Range
 		// amortizes an entire copy of the map: we can promote the dirty copy
 		// immediately!
 		m.mu.Lock()
-		read, _ = m.read.Load().(readOnly)
+		read = m.loadReadOnly()
 		if read.amended {
-			read = readOnly{m: m.dirty}
+			read = readOnly[K, V]{m: m.dirty}
 			m.read.Store(read)
 			m.dirty = nil
 			m.misses = 0
@@ -356,28 +582,69 @@ func (m *Map) Range(f func(key, value any) bool) {
 	}
 }
 
+// All returns an iterator over each key and value present in the map.
+// It has the same guarantees as Range: no key is visited more than once.
+func (m *Map[K, V]) All() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		m.Range(yield)
+	}
+}
+
+// Keys returns an iterator over each key present in the map.
+// It has the same guarantees as Range: no key is visited more than once.
+func (m *Map[K, V]) Keys() iter.Seq[K] {
+	return func(yield func(K) bool) {
+		m.Range(func(key K, _ V) bool {
+			return yield(key)
+		})
+	}
+}
+
+// Values returns an iterator over the value of each key present in the map.
+// It has the same guarantees as Range: no key is visited more than once.
+func (m *Map[K, V]) Values() iter.Seq[V] {
+	return func(yield func(V) bool) {
+		m.Range(func(_ K, value V) bool {
+			return yield(value)
+		})
+	}
+}
+
 // Count returns the number of elements within the map.
-func (m *Map) Count() int64 {
-	return atomic.LoadInt64(&m.count)
+//
+// Count is cheap and never blocks, but it is approximate while the map is
+// being modified: it is only exact once all operations have returned.
+// Use Len for an exact number.
+func (m *Map[K, V]) Count() int64 {
+	return m.count.sum()
+}
+
+// Len returns the number of elements within the map. Unlike Count, it is
+// exact: it waits for the writes in progress, and blocks writers until it
+// has summed the count.
+func (m *Map[K, V]) Len() int {
+	m.lens.lockAll()
+	defer m.lens.unlockAll()
+	return int(m.count.sum())
 }
 
-func (m *Map) missLocked() {
+func (m *Map[K, V]) missLocked() {
 	m.misses++
 	if m.misses < len(m.dirty) {
 		return
 	}
-	m.read.Store(readOnly{m: m.dirty})
+	m.read.Store(readOnly[K, V]{m: m.dirty})
 	m.dirty = nil
 	m.misses = 0
 }
 
-func (m *Map) dirtyLocked() {
+func (m *Map[K, V]) dirtyLocked() {
 	if m.dirty != nil {
 		return
 	}
 
-	read, _ := m.read.Load().(readOnly)
-	m.dirty = make(map[any]*entry, len(read.m))
+	read := m.loadReadOnly()
+	m.dirty = make(map[K]*entry[V], len(read.m))
 	for k, e := range read.m {
 		if !e.tryExpungeLocked() {
 			m.dirty[k] = e
@@ -385,7 +652,7 @@ func (m *Map) dirtyLocked() {
 	}
 }
 
-func (e *entry) tryExpungeLocked() (isExpunged bool) {
+func (e *entry[V]) tryExpungeLocked() (isExpunged bool) {
 	p := atomic.LoadPointer(&e.p)
 	for p == nil {
 		if atomic.CompareAndSwapPointer(&e.p, nil, expunged) {
@@ -0,0 +1,16 @@
+package cmap
+
+import (
+	"unsafe"
+)
+
+// oldChash is chash as it was before hash/maphash, hashing the key as an
+// interface value with the runtime's nilinterhash. It is kept, in a test, only
+// to benchmark chash against.
+func oldChash(i any, seed uintptr) uintptr {
+	return nilinterhash(unsafe.Pointer(&i), seed)
+}
+
+//go:linkname nilinterhash runtime.nilinterhash
+//go:noescape
+func nilinterhash(p unsafe.Pointer, h uintptr) uintptr
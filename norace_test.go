@@ -0,0 +1,5 @@
+//go:build !race
+
+package cmap_test
+
+const raceEnabled = false
@@ -0,0 +1,123 @@
+package cmap
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ResizeDirection tells whether a resize grows or shrinks a CMap.
+type ResizeDirection uint8
+
+const (
+	// ResizeGrow is a resize to more buckets.
+	ResizeGrow ResizeDirection = iota
+	// ResizeShrink is a resize to fewer buckets.
+	ResizeShrink
+)
+
+func (d ResizeDirection) String() string {
+	if d == ResizeShrink {
+		return "shrink"
+	}
+	return "grow"
+}
+
+// ResizeEvent describes a resize of a CMap from 1<<OldB to 1<<NewB buckets.
+type ResizeEvent struct {
+	OldB      uint8
+	NewB      uint8
+	Direction ResizeDirection
+
+	// Duration is the time from the start of the resize until its last
+	// bucket was evacuted. It is zero in a start event.
+	Duration time.Duration
+
+	// Keys is the number of elements in the map when the resize started,
+	// and the number of elements moved to the new buckets when it finished.
+	Keys int64
+}
+
+// ResizeObserver receives the resizes of a CMap, see WithResizeObserver.
+//
+// The methods are called synchronously by the goroutine that starts or
+// finishes the resize, which is usually a writer of the map, so they should
+// return quickly. They are never called with a lock of the map held, so
+// they may use the map, but must not wait for a resize of it, as by
+// WaitResize or Reserve and Compact with wait set.
+type ResizeObserver interface {
+	ResizeStarted(e ResizeEvent)
+	ResizeFinished(e ResizeEvent)
+}
+
+// WithResizeObserver sets the observer notified of every resize of the map.
+func WithResizeObserver(o ResizeObserver) Option {
+	return func(c *config) {
+		c.observer = o
+	}
+}
+
+// ResizeStats are the totals of the resizes a CMap has finished.
+type ResizeStats struct {
+	Grows     uint64
+	Shrinks   uint64
+	KeysMoved uint64
+	Duration  time.Duration // total time spent resizing
+}
+
+type resizeStats struct {
+	grows    uint64
+	shrinks  uint64
+	moved    uint64
+	duration int64
+}
+
+// ResizeStats returns the totals of the resizes m has finished.
+func (m *CMap[K, V]) ResizeStats() ResizeStats {
+	return ResizeStats{
+		Grows:     atomic.LoadUint64(&m.stats.grows),
+		Shrinks:   atomic.LoadUint64(&m.stats.shrinks),
+		KeysMoved: atomic.LoadUint64(&m.stats.moved),
+		Duration:  time.Duration(atomic.LoadInt64(&m.stats.duration)),
+	}
+}
+
+// resizeStarted notifies the observer that m starts to resize from old to n.
+func (m *CMap[K, V]) resizeStarted(n, old *node[K, V]) {
+	if o := m.config().observer; o != nil {
+		o.ResizeStarted(ResizeEvent{
+			OldB:      old.B,
+			NewB:      n.B,
+			Direction: resizeDirection(n, old),
+			Keys:      m.Count(),
+		})
+	}
+}
+
+// resizeFinished records the resize of m from old to n, which has just
+// evacuted its last bucket, and notifies the observer.
+func (m *CMap[K, V]) resizeFinished(n, old *node[K, V]) {
+	e := ResizeEvent{
+		OldB:      old.B,
+		NewB:      n.B,
+		Direction: resizeDirection(n, old),
+		Duration:  time.Since(n.start),
+		Keys:      atomic.LoadInt64(&n.moved),
+	}
+	if e.Direction == ResizeGrow {
+		atomic.AddUint64(&m.stats.grows, 1)
+	} else {
+		atomic.AddUint64(&m.stats.shrinks, 1)
+	}
+	atomic.AddUint64(&m.stats.moved, uint64(e.Keys))
+	atomic.AddInt64(&m.stats.duration, int64(e.Duration))
+	if o := m.config().observer; o != nil {
+		o.ResizeFinished(e)
+	}
+}
+
+func resizeDirection[K comparable, V any](n, old *node[K, V]) ResizeDirection {
+	if n.B < old.B {
+		return ResizeShrink
+	}
+	return ResizeGrow
+}
@@ -0,0 +1,196 @@
+package cmap
+
+import (
+	"errors"
+	"math"
+)
+
+// Option configures a CMap created by NewCMapWithOptions.
+type Option func(*config)
+
+type config struct {
+	initB      uint8   // log_2 of # of buckets of a new or cleared map
+	capacity   int     // number of elements to size initB for
+	loadFactor float64 // grow once a bucket holds more than 1<<B / loadFactor elements
+	grow       func(count int64, B uint8) bool
+	shrink     func(count int64, B uint8) bool
+	noShrink   bool
+	evacute    EvacuateMode
+	observer   ResizeObserver
+	hasher     any // Hasher[K] of the key type of the map
+}
+
+var defaultConfig = config{
+	initB:      mInitBit,
+	loadFactor: 13.0 / 2,
+	grow:       overflowGrow,
+	shrink:     belowShrink,
+}
+
+// WithInitialCapacity sizes a new CMap so that it can hold n elements
+// without growing, but for a chance of about 1 in 1000, as Reserve does.
+// The map never shrinks below that size. NewCMapWithOptions fails if n
+// needs more than 1<<31 buckets.
+func WithInitialCapacity(n int) Option {
+	return func(c *config) {
+		c.capacity = n
+	}
+}
+
+// EvacuateMode selects how a CMap moves its elements to the new buckets
+// after it has grown or shrunk.
+type EvacuateMode uint8
+
+const (
+	// EvacuateBackground evacuates the new buckets in a goroutine started by
+	// the resize, while operations evacuate the buckets they use on demand.
+	// This is the default.
+	EvacuateBackground EvacuateMode = iota
+	// EvacuateIncremental has every write evacuate a few more buckets after
+	// its own, like the runtime's map, so no goroutine is started.
+	EvacuateIncremental
+	// EvacuateSync has writes finish any evacuation in progress before they
+	// return, so the write that starts a resize also completes it.
+	EvacuateSync
+)
+
+// WithEvacuateMode sets how the map evacuates its buckets after a resize.
+func WithEvacuateMode(mode EvacuateMode) Option {
+	return func(c *config) {
+		c.evacute = mode
+	}
+}
+
+// WithHasher sets the Hasher the map hashes and compares its keys with.
+// By default keys are hashed by hash/maphash and compared with ==.
+func WithHasher[K any](h Hasher[K]) Option {
+	return func(c *config) {
+		c.hasher = h
+	}
+}
+
+// WithLoadFactor sets how full a single bucket may get: the map grows once
+// a bucket holds more than 1<<B / f elements, where 1<<B is the number of
+// buckets. The default is 13/2.
+func WithLoadFactor(f float64) Option {
+	return func(c *config) {
+		c.loadFactor = f
+	}
+}
+
+// WithGrowThreshold sets the function that decides, after an insert, whether
+// a map holding count elements in 1<<B buckets grows to 1<<(B+1) buckets.
+// The default grows once count >= 1<<(2*B).
+func WithGrowThreshold(f func(count int64, B uint8) bool) Option {
+	return func(c *config) {
+		c.grow = f
+	}
+}
+
+// WithShrinkThreshold sets the function that decides, after a delete, whether
+// a map holding count elements in 1<<B buckets shrinks to 1<<(B-1) buckets.
+// The default shrinks once count < 1<<(B-1).
+func WithShrinkThreshold(f func(count int64, B uint8) bool) Option {
+	return func(c *config) {
+		c.shrink = f
+	}
+}
+
+// WithoutShrink keeps the map from ever shrinking.
+func WithoutShrink() Option {
+	return func(c *config) {
+		c.noShrink = true
+	}
+}
+
+// NewCMapWithOptions returns an initialized CMap configured by opts.
+// It returns an error if the options are invalid.
+func NewCMapWithOptions[K comparable, V any](opts ...Option) (*CMap[K, V], error) {
+	c := defaultConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	if _, ok := c.hasher.(Hasher[K]); c.hasher != nil && !ok {
+		return nil, errors.New("cmap: hasher does not match the key type")
+	}
+	m := &CMap[K, V]{cfg: &c}
+	n := m.getNode()
+	n.initBuckets()
+	return m, nil
+}
+
+// init validates c and sizes initB for capacity.
+func (c *config) init() error {
+	switch {
+	case c.capacity < 0:
+		return errors.New("cmap: negative initial capacity")
+	case !(c.loadFactor > 0) || math.IsInf(c.loadFactor, 1):
+		return errors.New("cmap: load factor must be positive and finite")
+	case c.grow == nil:
+		return errors.New("cmap: nil grow threshold")
+	case c.shrink == nil:
+		return errors.New("cmap: nil shrink threshold")
+	case c.evacute > EvacuateSync:
+		return errors.New("cmap: unknown evacuate mode")
+	}
+	c.initB = c.sizeFor(int64(c.capacity), c.initB)
+	if c.initB > mMaxBit {
+		return errors.New("cmap: initial capacity too large")
+	}
+	return nil
+}
+
+// sizeFor returns the smallest B, no less than minB, for which a map of
+// count elements in 1<<B buckets would not grow, or mMaxBit+1 if no B up to
+// mMaxBit will do. The elements do not spread evenly over the buckets, so B
+// is sized for the fullest bucket, see peakLoad, not for the average one.
+func (c *config) sizeFor(count int64, minB uint8) uint8 {
+	B := minB
+	for ; B <= mMaxBit; B++ {
+		if !c.overLoadFactor(peakLoad(count, B), B) && !c.grow(count, B) {
+			break
+		}
+	}
+	return B
+}
+
+// peakLoad returns the number of elements the fullest of 1<<B buckets holds,
+// but for a chance of about 1 in 1000, once count elements are hashed into
+// them. By Bernstein's inequality, a bucket of mean load μ holds more than
+// μ + sqrt(2μL) + 2L/3 elements with probability at most e^-L; L is taken as
+// ln(1000) plus ln(1<<B), for any of the buckets.
+func peakLoad(count int64, B uint8) int64 {
+	mean := float64(count) / float64(bucketShift(B))
+	l := math.Log(1000) + float64(B)*math.Ln2
+	peak := math.Ceil(mean + math.Sqrt(2*mean*l) + 2*l/3)
+	if peak >= float64(count) {
+		return count
+	}
+	return int64(peak)
+}
+
+// needGrow reports whether a node of 1<<B buckets should grow after an insert
+// left blen elements in a bucket and count elements in the map.
+func (c *config) needGrow(blen, count int64, B uint8) bool {
+	if B >= mMaxBit {
+		return false
+	}
+	return c.overLoadFactor(blen, B) || c.grow(count, B)
+}
+
+// needShrink reports whether a node of 1<<B buckets should shrink after a
+// delete left count elements in the map.
+func (c *config) needShrink(count int64, B uint8) bool {
+	if c.noShrink || B <= c.initB {
+		return false
+	}
+	return c.shrink(count, B)
+}
+
+// buckut len over loadfactor
+func (c *config) overLoadFactor(blen int64, B uint8) bool {
+	return float64(blen)*c.loadFactor > float64(bucketShift(B))
+}
@@ -0,0 +1,63 @@
+package cmap
+
+import "iter"
+
+// Snapshot is an immutable copy of the contents of a CMap, taken at a single
+// point in time by CMap.Snapshot. It is safe for concurrent use and does not
+// change when the CMap does.
+type Snapshot[K comparable, V any] struct {
+	mask   uintptr
+	seed   hashSeed
+	hasher Hasher[K]
+	count  int
+
+	buckets  []map[K]V                   // entries, only without a hasher
+	hbuckets []map[uintptr][]Entry[K, V] // entries by hash, only with a hasher
+}
+
+// Load returns the value stored in the snapshot for a key, or the zero value
+// if no value is present.
+// The ok result indicates whether value was found in the snapshot.
+func (s *Snapshot[K, V]) Load(key K) (value V, ok bool) {
+	if s.hasher == nil {
+		value, ok = s.buckets[chash(key, s.seed)&s.mask][key]
+		return
+	}
+	hash := uintptr(s.hasher.Hash(s.seed.seed, key))
+	es := s.hbuckets[hash&s.mask][hash]
+	if i := findEntry(s.hasher, es, key); i >= 0 {
+		return es[i].Value, true
+	}
+	return value, false
+}
+
+// Range calls f sequentially for each key and value present in the snapshot.
+// If f returns false, range stops the iteration.
+func (s *Snapshot[K, V]) Range(f func(key K, value V) bool) {
+	for _, b := range s.buckets {
+		for k, v := range b {
+			if !f(k, v) {
+				return
+			}
+		}
+	}
+	for _, b := range s.hbuckets {
+		for _, es := range b {
+			for _, e := range es {
+				if !f(e.Key, e.Value) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// All returns an iterator over each key and value present in the snapshot.
+func (s *Snapshot[K, V]) All() iter.Seq2[K, V] {
+	return s.Range
+}
+
+// Len returns the number of elements within the snapshot.
+func (s *Snapshot[K, V]) Len() int {
+	return s.count
+}